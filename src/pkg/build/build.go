@@ -248,8 +248,9 @@ func (b *Build) Bundle() (*types.Bundle, error) {
 		return b.b, nil
 	}
 
+	sylog.Debugf("Getting image from %s source", b.c.SourceType())
 	if err := b.c.Get(b.d); err != nil {
-		return nil, fmt.Errorf("conveyor failed to get: %v", err)
+		return nil, fmt.Errorf("conveyor %s failed to get: %v", b.c.SourceType(), err)
 	}
 
 	bundle, err := b.c.Pack()
@@ -265,7 +266,11 @@ func getcp(def types.Definition) (ConveyorPacker, error) {
 	switch def.Header["bootstrap"] {
 	case "shub":
 		return &sources.ShubConveyorPacker{}, nil
-	case "docker", "docker-archive", "docker-daemon", "oci", "oci-archive":
+	case "library":
+		return &sources.LibraryConveyorPacker{}, nil
+	case "docker":
+		return &sources.DockerConveyorPacker{}, nil
+	case "docker-archive", "docker-daemon", "oci", "oci-archive":
 		return &sources.OCIConveyorPacker{}, nil
 	case "busybox":
 		return &sources.BusyBoxConveyorPacker{}, nil
@@ -15,6 +15,7 @@ import (
 // validURIs contains a list of known uris
 var validURIs = map[string]bool{
 	"shub":           true,
+	"library":        true,
 	"docker":         true,
 	"docker-archive": true,
 	"docker-daemon":  true,
@@ -37,6 +38,8 @@ type Packer interface {
 type ConveyorPacker interface {
 	Conveyor
 	Packer
+	// SourceType names the build source of the ConveyorPacker, e.g. shub
+	SourceType() string
 }
 
 // IsValidURI returns whether or not the given source is valid
@@ -207,3 +207,8 @@ func (cp *ArchConveyorPacker) insertRunScript() (err error) {
 func (cp *ArchConveyorPacker) CleanUp() {
 	os.RemoveAll(cp.b.Path)
 }
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *ArchConveyorPacker) SourceType() string {
+	return "arch"
+}
@@ -155,3 +155,8 @@ func (cp *BusyBoxConveyorPacker) insertRunScript() (err error) {
 func (c *BusyBoxConveyor) CleanUp() {
 	os.RemoveAll(c.b.Path)
 }
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *BusyBoxConveyorPacker) SourceType() string {
+	return "busybox"
+}
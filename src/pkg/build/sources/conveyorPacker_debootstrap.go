@@ -150,3 +150,8 @@ func (cp *DebootstrapConveyorPacker) insertRunScript(b *types.Bundle) (err error
 func (cp *DebootstrapConveyorPacker) CleanUp() {
 	os.RemoveAll(cp.b.Path)
 }
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *DebootstrapConveyorPacker) SourceType() string {
+	return "debootstrap"
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/containers/image/docker/reference"
+	"github.com/containers/image/types"
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// Environment variables holding Docker registry credentials
+const (
+	dockerUsernameEnv = "SINGULARITY_DOCKER_USERNAME"
+	dockerPasswordEnv = "SINGULARITY_DOCKER_PASSWORD"
+)
+
+// DockerConveyorPacker retrieves images from a Docker registry. The registry
+// protocol, including the token authentication flow, manifest lists and the
+// extraction of layers into the rootfs, is handled by the OCI conveyorPacker.
+// Requests are sent by containers/image, with its own HTTP client, retries
+// and progress output, as the shub client can't be injected into it
+type DockerConveyorPacker struct {
+	// Username and Password authenticate to the registry, overriding
+	// SINGULARITY_DOCKER_USERNAME and SINGULARITY_DOCKER_PASSWORD. Without
+	// them, credentials are looked up in ~/.netrc, pulls being anonymous
+	// when none are found
+	Username string
+	Password string
+	// Architecture selects the image from manifest lists, defaults to the host
+	// architecture
+	Architecture string
+
+	OCIConveyorPacker
+}
+
+// Get downloads the docker image referenced by recipe and extracts it into a new bundle
+func (cp *DockerConveyorPacker) Get(recipe sytypes.Definition) (err error) {
+	if recipe.Header["bootstrap"] != "docker" {
+		return fmt.Errorf("Docker ConveyorPacker does not support %s", recipe.Header["bootstrap"])
+	}
+
+	arch := cp.Architecture
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	sylog.Debugf("Getting docker image %s for architecture %s", recipe.Header["from"], arch)
+
+	cp.sysCtx = &types.SystemContext{
+		ArchitectureChoice: arch,
+	}
+	if creds, ok := cp.credentials(recipe.Header["from"]); ok {
+		cp.sysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: creds.username,
+			Password: creds.password,
+		}
+	}
+
+	return cp.OCIConveyorPacker.Get(recipe)
+}
+
+// credentials returns the credentials for the registry of the image ref.
+// Explicit fields take precedence over the environment, which takes
+// precedence over the netrc file
+func (cp *DockerConveyorPacker) credentials(ref string) (creds shubCredentials, ok bool) {
+	if cp.Username != "" || cp.Password != "" {
+		return shubCredentials{cp.Username, cp.Password}, true
+	}
+	if username := os.Getenv(dockerUsernameEnv); username != "" {
+		return shubCredentials{username, os.Getenv(dockerPasswordEnv)}, true
+	}
+
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(ref, `//`))
+	if err != nil {
+		// the reference is reported invalid when parsed for the pull
+		return creds, false
+	}
+
+	hosts := []string{reference.Domain(named)}
+	if hosts[0] == "docker.io" {
+		// Docker Hub is served from other hosts than its reference domain
+		hosts = append(hosts, "index.docker.io", "registry-1.docker.io")
+	}
+	for _, host := range hosts {
+		creds, ok, err := netrcLookup(netrcPath(), host)
+		if err != nil {
+			sylog.Warningf("Unable to read netrc file: %v", err)
+			return creds, false
+		}
+		if ok {
+			sylog.Debugf("Using netrc credentials of %s for docker image %s", host, ref)
+			return creds, true
+		}
+	}
+	return creds, false
+}
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *DockerConveyorPacker) SourceType() string {
+	return "docker"
+}
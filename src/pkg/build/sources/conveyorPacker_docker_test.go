@@ -0,0 +1,65 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDockerCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-credentials-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	netrc := filepath.Join(dir, "netrc")
+	data := "machine index.docker.io login hub password hubsecret\n" +
+		"machine registry.example.org login private password privatesecret\n"
+	if err := ioutil.WriteFile(netrc, []byte(data), 0600); err != nil {
+		t.Fatalf("unable to write netrc file: %v", err)
+	}
+
+	defer os.Setenv("NETRC", os.Getenv("NETRC"))
+	defer os.Setenv(dockerUsernameEnv, os.Getenv(dockerUsernameEnv))
+	defer os.Setenv(dockerPasswordEnv, os.Getenv(dockerPasswordEnv))
+	os.Setenv("NETRC", netrc)
+
+	tests := []struct {
+		name     string
+		cp       DockerConveyorPacker
+		username string
+		password string
+		ref      string
+		ok       bool
+		want     shubCredentials
+	}{
+		{"Fields", DockerConveyorPacker{Username: "user", Password: "pass"}, "envuser", "envpass", "//alpine", true, shubCredentials{"user", "pass"}},
+		{"Environment", DockerConveyorPacker{}, "envuser", "envpass", "//alpine", true, shubCredentials{"envuser", "envpass"}},
+		{"DockerHub", DockerConveyorPacker{}, "", "", "//alpine:3.8", true, shubCredentials{"hub", "hubsecret"}},
+		{"Registry", DockerConveyorPacker{}, "", "", "//registry.example.org/team/image", true, shubCredentials{"private", "privatesecret"}},
+		{"Anonymous", DockerConveyorPacker{}, "", "", "//quay.io/team/image", false, shubCredentials{}},
+		{"InvalidReference", DockerConveyorPacker{}, "", "", "//Invalid:Reference:", false, shubCredentials{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(dockerUsernameEnv, tt.username)
+			os.Setenv(dockerPasswordEnv, tt.password)
+
+			creds, ok := tt.cp.credentials(tt.ref)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, expected %v", ok, tt.ok)
+			}
+			if creds != tt.want {
+				t.Errorf("got credentials %+v, expected %+v", creds, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/library/client"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// defaultLibraryURL is the Container Library queried when none is configured
+const defaultLibraryURL = "https://library.sylabs.io"
+
+// LibraryConveyorPacker retrieves images from the Sylabs Container Library,
+// referenced as [entity/][collection/]container[:tag]
+type LibraryConveyorPacker struct {
+	// LibraryURL is the base URL of the library API, defaults to https://library.sylabs.io
+	LibraryURL string
+	// AuthToken is the bearer token authenticating to the library
+	AuthToken string
+	// Retries is the number of times a failed download is retried
+	Retries int
+
+	recipe types.Definition
+	b      *types.Bundle
+	// d downloads the image with the Singularity Hub client, sharing its
+	// transport, retries and checks
+	d ShubConveyorPacker
+	localPacker
+}
+
+// Get downloads the library image referenced by recipe into a new bundle
+func (cp *LibraryConveyorPacker) Get(recipe types.Definition) (err error) {
+	sylog.Debugf("Getting container from Library")
+	cp.recipe = recipe
+
+	ref := strings.TrimPrefix(recipe.Header["from"], "library://")
+	ref = strings.TrimPrefix(ref, "//")
+	if !client.IsLibraryPullRef(ref) {
+		return fmt.Errorf("not a valid library reference: %s", ref)
+	}
+	if !strings.Contains(ref, ":") {
+		ref += ":latest"
+	}
+
+	libraryURL := cp.LibraryURL
+	if libraryURL == "" {
+		libraryURL = defaultLibraryURL
+	}
+	imageURL := strings.TrimSuffix(libraryURL, "/") + "/v1/imagefile/" + ref
+
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return fmt.Errorf("invalid library URL %s: %v", libraryURL, err)
+	}
+
+	//create bundle to build into
+	cp.b, err = types.NewBundle("sbuild-library")
+	if err != nil {
+		return
+	}
+
+	cp.d = ShubConveyorPacker{
+		Retries:     cp.Retries,
+		manifest:    &shubAPIResponse{Image: imageURL},
+		authHost:    u.Hostname(),
+		bearerToken: cp.AuthToken,
+	}
+
+	tmpfile, err := cp.d.createImageFile(cp.b.Path)
+	if err != nil {
+		return err
+	}
+	defer tmpfile.Close()
+
+	sylog.Debugf("Pulling from URL: %s", imageURL)
+	if err = cp.d.downloadToFile(context.Background(), tmpfile, ""); err != nil {
+		return fmt.Errorf("failed to get image from Library: %v", err)
+	}
+
+	cp.localPacker, err = getLocalPacker(cp.d.tmpfile, cp.b)
+	if err != nil {
+		return fmt.Errorf("failed to create local packer for downloaded image: %s: %v", imageFormat(cp.d.tmpfile), err)
+	}
+	return nil
+}
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *LibraryConveyorPacker) SourceType() string {
+	return "library"
+}
+
+// CleanUp removes any tmpfs owned by the conveyorPacker on the filesystem
+func (cp *LibraryConveyorPacker) CleanUp() {
+	cp.d.CleanUp()
+	if cp.b != nil {
+		removeBundle(cp.b.Path)
+	}
+}
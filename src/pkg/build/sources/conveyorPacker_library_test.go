@@ -0,0 +1,63 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources_test
+
+import (
+	"testing"
+
+	"github.com/singularityware/singularity/src/pkg/build/sources"
+	"github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/test"
+)
+
+const (
+	libraryURI = "library://alpine:latest"
+)
+
+// TestLibraryConveyor tests if we can pull an image from the container library
+func TestLibraryConveyor(t *testing.T) {
+
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	def, err := types.NewDefinitionFromURI(libraryURI)
+	if err != nil {
+		t.Fatalf("unable to parse URI %s: %v\n", libraryURI, err)
+	}
+
+	cp := &sources.LibraryConveyorPacker{}
+
+	err = cp.Get(def)
+	//clean up tmpfs since assembler isnt called
+	defer cp.CleanUp()
+	if err != nil {
+		t.Fatalf("failed to Get from %s: %v\n", libraryURI, err)
+	}
+}
+
+// TestLibraryInvalidReference checks that invalid references are rejected before any download
+func TestLibraryInvalidReference(t *testing.T) {
+	for _, uri := range []string{
+		"library://User/container",
+		"library://entity/collection/container/extra",
+		"library://container:",
+	} {
+		def, err := types.NewDefinitionFromURI(uri)
+		if err != nil {
+			t.Fatalf("unable to parse URI %s: %v", uri, err)
+		}
+
+		cp := &sources.LibraryConveyorPacker{}
+		if err := cp.Get(def); err == nil {
+			cp.CleanUp()
+			t.Fatalf("failed to catch invalid reference %s", uri)
+		}
+	}
+}
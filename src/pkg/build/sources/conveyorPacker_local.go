@@ -94,3 +94,8 @@ func (cp *LocalConveyorPacker) Get(recipe types.Definition) (err error) {
 	cp.localPacker, err = getLocalPacker(cp.src, cp.b)
 	return err
 }
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *LocalConveyorPacker) SourceType() string {
+	return "localimage"
+}
@@ -42,6 +42,8 @@ type OCIConveyorPacker struct {
 	tmpfsRef  types.ImageReference
 	policyCtx *signature.PolicyContext
 	imgConfig imgspecv1.ImageConfig
+	// sysCtx configures access to the image source, e.g. registry credentials
+	sysCtx *types.SystemContext
 }
 
 // Get downloads container information from the specified source
@@ -153,6 +155,7 @@ func (cp *OCIConveyorPacker) Pack() (*sytypes.Bundle, error) {
 func (cp *OCIConveyorPacker) fetch() (err error) {
 	err = copy.Image(context.Background(), cp.policyCtx, cp.tmpfsRef, cp.srcRef, &copy.Options{
 		ReportWriter: os.Stderr,
+		SourceCtx:    cp.sysCtx,
 	})
 	if err != nil {
 		return err
@@ -377,3 +380,8 @@ func (cp *OCIConveyorPacker) insertEnv() (err error) {
 func (cp *OCIConveyorPacker) CleanUp() {
 	os.RemoveAll(cp.b.Path)
 }
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *OCIConveyorPacker) SourceType() string {
+	return "oci"
+}
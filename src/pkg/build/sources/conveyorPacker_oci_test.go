@@ -46,6 +46,27 @@ func TestOCIConveyorDocker(t *testing.T) {
 	}
 }
 
+// TestDockerConveyor tests if we can pull an alpine image for the host
+// architecture from dockerhub
+func TestDockerConveyor(t *testing.T) {
+	test.DropPrivilege(t)
+	defer test.ResetPrivilege(t)
+
+	def, err := types.NewDefinitionFromURI(dockerURI)
+	if err != nil {
+		t.Fatalf("unable to parse URI %s: %v\n", dockerURI, err)
+	}
+
+	cp := &sources.DockerConveyorPacker{}
+
+	err = cp.Get(def)
+	//clean up tmpfs since assembler isnt called
+	defer cp.CleanUp()
+	if err != nil {
+		t.Fatalf("failed to Get from %s: %v\n", dockerURI, err)
+	}
+}
+
 // TestOCIConveyorDockerArchive tests if we can use a docker save archive
 // as a source
 func TestOCIConveyorDockerArchive(t *testing.T) {
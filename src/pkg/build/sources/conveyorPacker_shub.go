@@ -6,16 +6,27 @@
 package sources
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
@@ -25,146 +36,1808 @@ import (
 
 const defaultRegistry string = `singularity-hub.org/api/container/`
 
-// ShubURI stores the various components of a singularityhub URI
+// defaultManifestAccept is the Accept header of manifest requests, unless configured
+const defaultManifestAccept = "application/json"
+
+// defaultBundlePrefix starts the name of the bundle directory of pulls
+const defaultBundlePrefix = "sbuild-shub"
+
+// shubDefaultUserEnv holds the user applied to references omitting it, so
+// images of a single organization can be referenced as container[:tag]
+const shubDefaultUserEnv = "SINGULARITY_SHUB_DEFAULT_USER"
+
+// regular expressions for each URI component
+const (
+	registryRegexp  = `([-.a-zA-Z0-9/]{1,64}\/)?`          //target is very open, outside registry hosts
+	nameRegexp      = `([-a-zA-Z0-9]{1,39}\/)`             //target valid github usernames
+	containerRegexp = `([-_.a-zA-Z0-9]{1,64})`             //target valid github repo names
+	tagRegexp       = `(:[-_.a-zA-Z0-9/]{1,64})?`          //target is very open, file extensions or branch names
+	digestRegexp    = `(\@([a-z0-9]+:)?[a-f0-9]{32,128})?` //target md5, sha256 or sha512 sum hash
+	fileRegexp      = `(#[-_.a-zA-Z0-9/]{1,255})?`         //target file paths within the container
+)
+
+// reservedNames lists, for known registries, the user and container names
+// colliding with segments of the registry API paths
+var reservedNames = map[string]struct {
+	users      []string
+	containers []string
+}{
+	defaultRegistry: {
+		users:      []string{"api", "collection", "container", "search"},
+		containers: []string{"api", "collection", "container", "search"},
+	},
+}
+
+// ShubURI stores the various components of a singularityhub URI. The tag
+// may contain slashes, as branch names do. The file, with its leading `#`,
+// selects an image of containers holding several
 type ShubURI struct {
 	registry   string
 	user       string
 	container  string
 	tag        string
 	digest     string
+	file       string
 	defaultReg bool
 }
 
-type shubAPIResponse struct {
-	Image   string `json:"image"`
-	Name    string `json:"name"`
-	Tag     string `json:"tag"`
-	Version string `json:"version"`
+// RewriteRule rewrites references matching Pattern with Replacement, which
+// may refer to submatches as in regexp.Regexp.ReplaceAllString. Rules apply
+// to references without their scheme, e.g. `olduser/container:tag`
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+type shubAPIResponse struct {
+	Image   string            `json:"image"`
+	Name    string            `json:"name"`
+	Tag     string            `json:"tag"`
+	Version string            `json:"version"`
+	Files   map[string]string `json:"files,omitempty"`
+}
+
+// ShubManifest is the image metadata reported by the registry for a reference
+type ShubManifest struct {
+	// Image is the URL the image is downloaded from
+	Image string
+	// Name is the user/container name of the image
+	Name string
+	// Tag is the tag of the image
+	Tag string
+	// Version is the version of the image, a hash of its content
+	Version string
+	// Files maps the names of the images of containers holding several to
+	// the URL they are downloaded from
+	Files map[string]string
+}
+
+// ShubConveyorPacker only needs to hold the conveyor to have the needed data to pack
+type ShubConveyorPacker struct {
+	// MinImageSize is the smallest image size in bytes accepted for download, 0 means unbounded
+	MinImageSize int64
+	// MaxImageSize is the largest image size in bytes accepted for download, 0 means unbounded
+	MaxImageSize int64
+	// SkipSizeCheck disables the check of the size received against the
+	// Content-Length, for proxies rewriting it. The digest of the reference,
+	// if any, is still verified
+	SkipSizeCheck bool
+	// CheckAvailability issues a HEAD request for the image before downloading
+	// it, failing early when the image is unavailable or won't fit on disk
+	CheckAvailability bool
+	// Cache stores downloaded images for later builds, nil disables caching
+	Cache Cache
+	// OnCachePut is called after an image was written into the cache, with
+	// the path of the entry when the cache stores files. An error is
+	// reported but doesn't fail the build
+	OnCachePut func(key, path string) error
+	// Insecure disables TLS certificate verification, overriding SINGULARITY_SHUB_INSECURE
+	Insecure bool
+	// CABundle is the path of a PEM bundle of trusted CAs, overriding SINGULARITY_SHUB_CA_BUNDLE
+	CABundle string
+	// MinTLSVersion is the oldest TLS version negotiated with the registry,
+	// e.g. tls.VersionTLS11, overriding SINGULARITY_SHUB_MIN_TLS. Defaults to TLS 1.2
+	MinTLSVersion uint16
+	// Timeout bounds each request to the registry, overriding SINGULARITY_SHUB_TIMEOUT.
+	// Defaults to 30 seconds for the manifest request, image downloads are unbounded
+	Timeout time.Duration
+	// StallTimeout aborts image downloads receiving no bytes for that long,
+	// which are then retried, resuming where they stopped when the server
+	// supports range requests. 0 disables stall detection
+	StallTimeout time.Duration
+	// VerifySignature fails the build unless the pulled image is a SIF
+	// carrying a valid signature for its system partition
+	VerifySignature bool
+	// AuthToken is used to fetch signer keys missing from the local keyring
+	AuthToken string
+	// Resolver is the DNS resolver used to reach the registry
+	Resolver *net.Resolver
+	// DNSServer is the address of a DNS server to resolve registry hosts
+	// with, e.g. 8.8.8.8, when no Resolver is set
+	DNSServer string
+	// MaxIdleConns bounds the idle connections kept open for reuse, defaults to 10
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept open, defaults to 90 seconds
+	IdleConnTimeout time.Duration
+	// Lockfile is the path of a Lockfile pinning references to images,
+	// consulted before resolving references with the registry
+	Lockfile string
+	// UpdateLockfile pins the references missing from the Lockfile once
+	// their image is retrieved
+	UpdateLockfile bool
+	// MemoryImageSize is the largest announced size in bytes of images
+	// downloaded into memory, and checked, before being written for packing.
+	// As packers read images from files, ScratchDir should then be a tmpfs
+	// on read-only systems. Larger images are downloaded to a file, as are
+	// all images when 0, with Decompress or with SkipSizeCheck
+	MemoryImageSize int64
+	// ScratchDir is where images are downloaded before being packed, each
+	// pull using its own directory within it. Images are downloaded into
+	// the bundle when empty
+	ScratchDir string
+	// BundlePrefix starts the name of the bundle directory of pulls, e.g.
+	// to tell the bundles of build jobs apart, defaults to sbuild-shub
+	BundlePrefix string
+	// Architecture is the architecture SIF images are expected to be built
+	// for, defaults to the host architecture. StrictArch fails pulls of
+	// images built for another one, which are otherwise only warned about
+	Architecture string
+	StrictArch   bool
+	// RewriteImageURL transforms the image URL of the manifest before the
+	// image is downloaded, e.g. to sign it. The manifest, results and
+	// lockfile keep the original URL
+	RewriteImageURL func(url string) (string, error)
+	// Chunks is the number of parallel range requests images are downloaded
+	// with, on servers supporting them. AutoChunks tunes it from the image
+	// size and the measured throughput. Images are downloaded in a single
+	// request by default, or when set to 1
+	Chunks int
+	// VerifyChunk checks each chunk downloaded in parallel. A corrupt chunk
+	// is downloaded again, as many times as Retries allows, without
+	// discarding the rest of the image
+	VerifyChunk ChunkVerifier
+	// RedirectHosts restricts the hosts image downloads may be redirected
+	// to, names starting with a dot matching any subdomain, e.g.
+	// .storage.googleapis.com. Redirects to any host are followed when empty
+	RedirectHosts []string
+	// PartialDir keeps the downloads of images in progress, with a sidecar
+	// recording their URL and entity tag, so a pull interrupted, even by
+	// the process being killed, is resumed by the next pull of the same
+	// reference. Images are then downloaded in a single request
+	PartialDir string
+	// LogFile, when set, receives a record of each pull for audit trails:
+	// the requests sent with their status, and the size and digest of the
+	// image. It is truncated when the pull starts, sylog logging is unchanged
+	LogFile string
+	// Proxy is the URL of the proxy all requests go through, possibly with
+	// credentials which are never logged, instead of the proxy of the environment
+	Proxy string
+	// IsolatedTransport gives the packer its own connection pool instead of
+	// sharing one with the packers using the same connection settings
+	IsolatedTransport bool
+	// DisableHTTP2 restricts connections to HTTP/1.1, working around proxies
+	// mishandling HTTP/2
+	DisableHTTP2 bool
+	// NewestSemver selects the greatest semantic version tag of the container
+	// when the reference doesn't specify a tag
+	NewestSemver bool
+	// Decompress transparently decompresses images served gzip or bzip2
+	// compressed, as detected from their content
+	Decompress bool
+	// FileMode is the permission of the downloaded image before applying the
+	// umask, 0 keeps the restrictive default of 0600
+	FileMode os.FileMode
+	// Username and Password authenticate requests to the registry, overriding
+	// SINGULARITY_SHUB_USERNAME and SINGULARITY_SHUB_PASSWORD. Without them,
+	// credentials are looked up in the CredentialStore and ~/.netrc
+	Username string
+	Password string
+	// CredentialStore is the path of a Docker style JSON credential file
+	CredentialStore string
+	// PullTimeout bounds the whole pull, from resolving the manifest to
+	// packing the image, 0 means unbounded
+	PullTimeout time.Duration
+	// Retries is the number of times a transiently failed request is retried
+	Retries int
+	// RetryBudget bounds the retries of a whole pull, shared by the manifest
+	// and image requests, instead of Retries bounding each request
+	RetryBudget int
+	// RetryClassifier decides which errors are retried, defaults to IsTransientError
+	RetryClassifier RetryClassifier
+	// Stage selects the base image of a named stage of a multi-stage
+	// definition, read from its `<stage>.from` header instead of `from`
+	Stage string
+	// ExpandEnv expands $VAR and ${VAR} in the reference of the definition,
+	// before rewrites, so base images can be parameterized. Undefined
+	// variables fail the build
+	ExpandEnv bool
+	// Rewrites are applied in order to the reference before parsing it,
+	// easing migrations between registries
+	Rewrites []RewriteRule
+	// Registry overrides the registry of the reference, so the same
+	// user/container can be pulled from different hosts
+	Registry string
+	// TagFallback lists the tags tried in order when the requested tag
+	// doesn't exist, by default a missing tag fails the build
+	TagFallback []string
+	// RejectReservedNames fails references whose user or container name
+	// collides with the API paths of their registry, see ValidateReserved
+	RejectReservedNames bool
+	// StrictName fails the build when the name reported by the manifest
+	// doesn't match the requested user/container, instead of warning
+	StrictName bool
+	// Headers are added to every registry request, manifest and image ones
+	// alike, e.g. X-Registry-Project for registries routing on it. They are
+	// dropped from requests redirected to another host. Headers set by the
+	// packer or the HTTP client, e.g. Authorization, are rejected
+	Headers http.Header
+	// ManifestAccept is the Accept header of manifest requests, selecting
+	// the manifest schema on registries serving several, application/json
+	// by default
+	ManifestAccept string
+	// Mirrors lists registries the manifest is requested from, in order,
+	// when the primary registry fails. Mirrors only receive the credentials
+	// of their own RegistryProfile, never those of the primary registry
+	Mirrors []string
+	// RecordProvenance records the resolved reference, image URL and digest of the
+	// pulled image in the shub-provenance.json file of the bundle
+	RecordProvenance bool
+	// AlternativeRegistry is suggested to users when a container was removed
+	// from the registry, which answers 410 Gone for deprecated content
+	AlternativeRegistry string
+	// RateLimits throttles the requests sent to each registry host, keyed
+	// by host name. Hosts without entry aren't throttled
+	RateLimits map[string]RateLimit
+	// Tracer creates spans around the phases of pulls, none by default
+	Tracer Tracer
+	// DryRun logs the requests pulls would send, with credentials redacted,
+	// and returns ErrDryRun without sending any
+	DryRun bool
+	// RegistryProfiles holds the settings of registries, keyed by host,
+	// selected by the host each request is sent to
+	RegistryProfiles map[string]RegistryProfile
+
+	recipe     sytypes.Definition
+	srcURI     ShubURI
+	tmpfile    string
+	downloaded int64
+	manifest   *shubAPIResponse
+	b          *sytypes.Bundle
+	scratch    string
+	imageURL   string
+	lockKey    string
+	locked     bool
+	deadline   time.Time
+	result     PullResult
+	localPacker
+
+	// traceCtx is the context of the last GetContext, parent of the span of
+	// Pack
+	traceCtx context.Context
+	// retriesUsed counts the retries of the pull in progress, against the
+	// RetryBudget
+	retriesUsed int64
+
+	// authHost and bearerToken replace the registry host and credentials
+	// when downloading on behalf of another source, e.g. the library
+	authHost    string
+	bearerToken string
+
+	// logw is the open LogFile of the pull in progress
+	logw *os.File
+	// etag and lastModified identify the version of the image being
+	// downloaded, partial is the partial download in PartialDir
+	etag         string
+	lastModified string
+	partial      string
+
+	// transports holds the transports of the hosts requests were sent to,
+	// by connection settings, guarded by transportMu
+	transports  map[transportKey]*http.Transport
+	transportMu sync.Mutex
+
+	// mu guards cancel, which stops an in-flight GetContext
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	// running is held for the duration of GetContext, so CleanUp doesn't
+	// remove the bundle while a download is still writing into it
+	running sync.WaitGroup
+}
+
+// Get downloads container from Singularityhub
+func (cp *ShubConveyorPacker) Get(recipe sytypes.Definition) (err error) {
+	return cp.GetContext(context.Background(), recipe)
+}
+
+// GetContext downloads container from Singularityhub, aborting the requests
+// in flight when ctx is cancelled
+func (cp *ShubConveyorPacker) GetContext(ctx context.Context, recipe sytypes.Definition) (err error) {
+	cp.running.Add(1)
+	defer cp.running.Done()
+
+	cp.traceCtx = ctx
+	ctx, span := cp.startSpan(ctx, "shub.pull")
+	defer func() { span.End(err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if cp.PullTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cp.PullTimeout)
+		defer cancel()
+		cp.deadline = time.Now().Add(cp.PullTimeout)
+	}
+
+	cp.mu.Lock()
+	cp.cancel = cancel
+	cp.mu.Unlock()
+
+	err = cp.get(ctx, recipe)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("pull exceeded deadline: %v", err)
+	}
+	return err
+}
+
+// get resolves and downloads the image of recipe, then selects its local packer
+func (cp *ShubConveyorPacker) get(ctx context.Context, recipe sytypes.Definition) (err error) {
+	sylog.Debugf("Getting container from Shub")
+	cp.logConfig()
+	if cp.DryRun {
+		return cp.dryRun(recipe)
+	}
+
+	if err = cp.openLog(); err != nil {
+		return err
+	}
+	defer func() { cp.closeLog(err) }()
+
+	start := time.Now()
+	cp.result = PullResult{}
+	atomic.StoreInt64(&cp.retriesUsed, 0)
+
+	if err = cp.traceResolve(ctx, recipe); err != nil {
+		return err
+	}
+	cp.logf("resolved %s to image %s version %s", cp.srcURI.Canonical(), redactURL(cp.manifest.Image), cp.manifest.Version)
+
+	//create bundle to build into
+	prefix, err := cp.bundlePrefix()
+	if err != nil {
+		return err
+	}
+	cp.b, err = sytypes.NewBundle(prefix)
+	if err != nil {
+		return
+	}
+
+	// retrieve the image
+	dir, err := cp.pullDir()
+	if err != nil {
+		return err
+	}
+	tmpfile, err := cp.createImageFile(dir)
+	if err != nil {
+		return err
+	}
+	defer tmpfile.Close()
+
+	if err = cp.traceFetch(ctx, tmpfile); err != nil {
+		return fmt.Errorf("failed to get image from Shub: %v", err)
+	}
+	cp.recordResult(start)
+
+	cp.localPacker, err = getLocalPacker(cp.tmpfile, cp.b)
+	if err != nil {
+		return fmt.Errorf("failed to create local packer for downloaded image: %s: %v", imageFormat(cp.tmpfile), err)
+	}
+	if err = cp.verifyArch(); err != nil {
+		return err
+	}
+
+	if cp.RecordProvenance {
+		if err = cp.writeProvenance(); err != nil {
+			return err
+		}
+	}
+
+	if cp.VerifySignature {
+		_, span := cp.startSpan(ctx, "shub.verify")
+		span.SetAttribute(TraceVerify, "signature")
+		err = cp.verifySignature()
+		span.End(err)
+		if err != nil {
+			return fmt.Errorf("unable to verify image from Shub: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// bundlePrefix returns the prefix of the bundle directory name, which must
+// not reach outside of the temporary directory
+func (cp *ShubConveyorPacker) bundlePrefix() (string, error) {
+	if cp.BundlePrefix == "" {
+		return defaultBundlePrefix, nil
+	}
+	if strings.ContainsAny(cp.BundlePrefix, `/\`) {
+		return "", fmt.Errorf("invalid bundle prefix %q, must be a file name", cp.BundlePrefix)
+	}
+	return cp.BundlePrefix, nil
+}
+
+// logConfig logs the effective settings of the pull, with the environment
+// and defaults applied
+func (cp *ShubConveyorPacker) logConfig() {
+	registry := cp.Registry
+	if registry == "" {
+		registry = "from reference"
+	}
+
+	cache := "disabled"
+	if fc, ok := cp.Cache.(*FileCache); ok {
+		cache = fc.dir
+	} else if cp.Cache != nil {
+		cache = fmt.Sprintf("%T", cp.Cache)
+	}
+
+	proxy := "from environment"
+	if p := cp.proxyURL(); p != "" {
+		proxy = redactURL(p)
+	}
+	if socket := os.Getenv(shubUnixSocketEnv); socket != "" {
+		proxy = "none, dialing unix socket " + socket
+	}
+
+	minTLS := "invalid"
+	if version, err := cp.minTLSVersion(); err == nil {
+		minTLS = tlsVersionName(version)
+	}
+
+	sylog.Debugf("Shub configuration: registry=%s timeout=%v stallTimeout=%v insecure=%v minTLS=%s http2=%v cache=%s proxy=%s retries=%d retryBudget=%d",
+		registry, cp.timeout(cp.registryHost()), cp.StallTimeout, cp.insecure(cp.registryHost()), minTLS, !cp.disableHTTP2(), cache, proxy, cp.Retries, cp.RetryBudget)
+}
+
+// resolve parses the shub reference of recipe, gets its manifest and the
+// URL its image is downloaded from
+func (cp *ShubConveyorPacker) resolve(ctx context.Context, recipe sytypes.Definition) (err error) {
+	cp.imageURL = ""
+	if err = cp.resolveManifest(ctx, recipe); err != nil {
+		return err
+	}
+
+	if cp.RewriteImageURL == nil {
+		return nil
+	}
+
+	if cp.imageURL, err = cp.RewriteImageURL(cp.manifest.Image); err != nil {
+		return fmt.Errorf("failed to rewrite image URL: %v", err)
+	}
+	sylog.Debugf("Rewrote image URL for %s", cp.srcURI.String())
+	return nil
+}
+
+// resolveManifest parses the shub reference of recipe and gets its manifest
+func (cp *ShubConveyorPacker) resolveManifest(ctx context.Context, recipe sytypes.Definition) (err error) {
+	if err = cp.parseRecipe(recipe); err != nil {
+		return err
+	}
+
+	if locked, err := cp.resolveLocked(); locked || err != nil {
+		return err
+	}
+
+	if cp.NewestSemver && cp.srcURI.tag == "" {
+		tag, err := cp.newestSemverTag(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to select newest version from Shub: %v", err)
+		}
+		sylog.Infof("Selected newest version %s for %s", tag, cp.srcURI.String())
+		cp.srcURI.tag = `:` + tag
+	}
+
+	// Get the image manifest
+	if err = cp.getManifest(ctx); err != nil {
+		return fmt.Errorf("failed to get manifest from Shub: %v", err)
+	}
+
+	if err = cp.checkManifestName(); err != nil {
+		return err
+	}
+	return cp.selectFile()
+}
+
+// selectFile selects the image of the file of the reference, if any, among
+// the files listed by the manifest
+func (cp *ShubConveyorPacker) selectFile() error {
+	if cp.srcURI.file == "" {
+		return nil
+	}
+
+	name := strings.TrimPrefix(cp.srcURI.file, `#`)
+	image, ok := cp.manifest.Files[name]
+	if !ok {
+		var files []string
+		for f := range cp.manifest.Files {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		return fmt.Errorf("file %s not found in %s, available files: %s", name, cp.srcURI.String(), strings.Join(files, ", "))
+	}
+
+	sylog.Debugf("Selected file %s of %s", name, cp.srcURI.String())
+	cp.manifest.Image = image
+	return nil
+}
+
+// checkManifestName compares the name reported by the manifest with the
+// requested user/container. Names match when their user and container are
+// equal ignoring case, as registries normalize them, any tag or digest in
+// the reported name being ignored. A mismatch is a warning, or an error when
+// StrictName is set, and manifests without name are accepted
+func (cp *ShubConveyorPacker) checkManifestName() error {
+	name := cp.manifest.Name
+	if name == "" {
+		return nil
+	}
+	if i := strings.IndexAny(name, `:@`); i >= 0 {
+		name = name[:i]
+	}
+
+	requested := cp.srcURI.user + cp.srcURI.container
+	if strings.EqualFold(name, requested) {
+		return nil
+	}
+
+	if cp.StrictName {
+		return fmt.Errorf("registry resolved %s to image %s", requested, cp.manifest.Name)
+	}
+	sylog.Warningf("Registry resolved %s to image %s", requested, cp.manifest.Name)
+	return nil
+}
+
+// parseRecipe parses the shub reference of recipe, applying rewrite rules
+// and the registry override
+func (cp *ShubConveyorPacker) parseRecipe(recipe sytypes.Definition) (err error) {
+	cp.recipe = recipe
+
+	from, err := cp.reference(recipe)
+	if err != nil {
+		return err
+	}
+	if cp.ExpandEnv {
+		if from, err = expandReference(from); err != nil {
+			return err
+		}
+	}
+	//references may be written fully qualified, with the shub scheme
+	from = strings.TrimPrefix(strings.TrimPrefix(from, "shub:"), `//`)
+	src := `//` + cp.rewrite(from)
+
+	//use custom parser to make sure we have a valid shub URI
+	cp.srcURI, err = ShubParseReference(src)
+	if err != nil {
+		return fmt.Errorf("invalid shub URI: %v", err)
+	}
+
+	if cp.Registry != "" {
+		uri, err := NewShubURI(cp.Registry, cp.srcURI.user, cp.srcURI.container, cp.srcURI.tag, cp.srcURI.digest)
+		if err != nil {
+			return fmt.Errorf("invalid registry override: %v", err)
+		}
+		uri.file = cp.srcURI.file
+		sylog.Infof("Overriding registry of %s with %s", cp.srcURI.String(), uri.registry)
+		cp.srcURI = uri
+	}
+	sylog.Debugf("Using registry %s", cp.srcURI.registry)
+
+	if cp.RejectReservedNames {
+		if err := cp.srcURI.ValidateReserved(); err != nil {
+			return fmt.Errorf("invalid shub URI: %v", err)
+		}
+	}
+	if _, err := cp.minTLSVersion(); err != nil {
+		return err
+	}
+	return cp.checkHeaders()
+}
+
+// Prefetch resolves and downloads the image of recipe into the cache,
+// without creating a bundle, so later builds find it already cached
+func (cp *ShubConveyorPacker) Prefetch(recipe sytypes.Definition) (err error) {
+	if cp.Cache == nil {
+		return fmt.Errorf("no cache configured to prefetch into")
+	}
+
+	ctx := context.Background()
+	if cp.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cp.PullTimeout)
+		defer cancel()
+	}
+
+	if err = cp.resolve(ctx, recipe); err != nil {
+		return err
+	}
+
+	cacheKey, err := ShubCacheKey(cp.srcURI)
+	if err != nil {
+		return err
+	}
+	if cached, ok := cp.cachedImage(cacheKey); ok {
+		cached.Close()
+		sylog.Infof("Image %s is already cached", cp.srcURI.String())
+		return nil
+	}
+
+	dir, err := ioutil.TempDir(cp.ScratchDir, "shub-prefetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile, err := cp.createImageFile(dir)
+	if err != nil {
+		return err
+	}
+	defer tmpfile.Close()
+
+	if err = cp.downloadToFile(ctx, tmpfile, cacheKey); err != nil {
+		return fmt.Errorf("failed to get image from Shub: %v", err)
+	}
+	cp.tmpfile = ""
+
+	return nil
+}
+
+// Pull resolves and downloads the image of recipe to dest, without creating
+// a bundle. The image is written to a temporary file in the directory of dest,
+// so it is on the same filesystem, then renamed over dest: an existing image
+// is only replaced, when force is set, once the new one is complete
+func (cp *ShubConveyorPacker) Pull(recipe sytypes.Definition, dest string, force bool) (err error) {
+	if _, err := os.Stat(dest); err == nil && !force {
+		return fmt.Errorf("image file %s already exists", dest)
+	}
+	if cp.DryRun {
+		return cp.dryRun(recipe)
+	}
+
+	ctx, span := cp.startSpan(context.Background(), "shub.pull")
+	defer func() { span.End(err) }()
+
+	if cp.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cp.PullTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	cp.result = PullResult{}
+	atomic.StoreInt64(&cp.retriesUsed, 0)
+
+	if err = cp.traceResolve(ctx, recipe); err != nil {
+		return err
+	}
+
+	tmpfile, err := cp.createImageFile(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmpfile.Close()
+		if err != nil {
+			os.Remove(tmpfile.Name())
+		}
+	}()
+
+	if err = cp.traceFetch(ctx, tmpfile); err != nil {
+		return fmt.Errorf("failed to get image from Shub: %v", err)
+	}
+	cp.recordResult(start)
+
+	// images are executable, unless configured otherwise
+	if cp.FileMode == 0 {
+		if err = chmodWithUmask(tmpfile.Name(), 0755); err != nil {
+			return fmt.Errorf("could not set image file permissions: %v", err)
+		}
+	}
+
+	if err = os.Rename(tmpfile.Name(), dest); err != nil {
+		return fmt.Errorf("could not move image to %s: %v", dest, err)
+	}
+	cp.tmpfile = dest
+
+	return nil
+}
+
+// Stream resolves the image of recipe and returns its content as a stream,
+// along with its expected size, -1 when the registry doesn't report it.
+// Nothing is written to disk nor cached, and as the content isn't buffered
+// its digest can't be verified. Images announced larger than MaxImageSize
+// are rejected, and reading the stream fails once it is exceeded. The
+// caller must close the stream
+func (cp *ShubConveyorPacker) Stream(ctx context.Context, recipe sytypes.Definition) (io.ReadCloser, int64, error) {
+	if err := cp.resolve(ctx, recipe); err != nil {
+		return nil, 0, err
+	}
+
+	var resp *http.Response
+	err := cp.retry(ctx, "Image request", func() (err error) {
+		resp, err = cp.openImage(ctx, 0)
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get image from Shub: %v", err)
+	}
+
+	if cp.MaxImageSize > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{&sizeLimitReader{r: resp.Body, max: cp.MaxImageSize}, resp.Body}, resp.ContentLength, nil
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// reference returns the shub reference of recipe, taken from the header of
+// the configured stage or from the top level `from` header
+func (cp *ShubConveyorPacker) reference(recipe sytypes.Definition) (string, error) {
+	if cp.Stage == "" {
+		return recipe.Header["from"], nil
+	}
+
+	from, ok := recipe.Header[cp.Stage+".from"]
+	if !ok || from == "" {
+		return "", fmt.Errorf("no shub reference found for stage %s", cp.Stage)
+	}
+	sylog.Debugf("Using base image %s of stage %s", from, cp.Stage)
+
+	return from, nil
+}
+
+// expandReference expands the environment variables of ref, failing with
+// the names of those undefined. Variables defined empty are accepted
+func expandReference(ref string) (string, error) {
+	var undefined []string
+	expanded := os.Expand(ref, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return value
+	})
+
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("undefined environment variables %s in shub reference %s", strings.Join(undefined, ", "), ref)
+	}
+	if expanded != ref {
+		sylog.Debugf("Expanded shub reference %s to %s", ref, expanded)
+	}
+	return expanded, nil
+}
+
+// rewrite applies the rewrite rules in order to the reference
+func (cp *ShubConveyorPacker) rewrite(ref string) string {
+	for _, rule := range cp.Rewrites {
+		if !rule.Pattern.MatchString(ref) {
+			continue
+		}
+
+		rewritten := rule.Pattern.ReplaceAllString(ref, rule.Replacement)
+		sylog.Infof("Rewriting reference %s to %s", ref, rewritten)
+		ref = rewritten
+	}
+	return ref
+}
+
+// Pack packs the downloaded image into the bundle, unless the pull
+// deadline has already passed
+func (cp *ShubConveyorPacker) Pack() (*sytypes.Bundle, error) {
+	if cp.localPacker == nil {
+		return nil, fmt.Errorf("no image was downloaded from Shub")
+	}
+	if !cp.deadline.IsZero() && time.Now().After(cp.deadline) {
+		return nil, fmt.Errorf("pull exceeded deadline of %v before packing", cp.PullTimeout)
+	}
+
+	ctx := cp.traceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := cp.startSpan(ctx, "shub.pack")
+	b, err := cp.localPacker.Pack()
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyBundle(b); err != nil {
+		return nil, fmt.Errorf("image from Shub was not packed correctly: %v", err)
+	}
+	return b, nil
+}
+
+// verifyBundle makes sure the packer left a non empty root filesystem in
+// the bundle, catching packers failing silently
+func verifyBundle(b *sytypes.Bundle) error {
+	if b == nil {
+		return fmt.Errorf("no bundle was created")
+	}
+
+	fi, err := os.Stat(b.Rootfs())
+	if err != nil {
+		return fmt.Errorf("bundle root filesystem is missing: %v", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("bundle root filesystem %s is not a directory", b.Rootfs())
+	}
+
+	entries, err := ioutil.ReadDir(b.Rootfs())
+	if err != nil {
+		return fmt.Errorf("could not read bundle root filesystem: %v", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("bundle root filesystem %s is empty", b.Rootfs())
+	}
+
+	return nil
+}
+
+// BundleDigest returns a sha256 digest of the bundle contents, computed from
+// the sorted path, type, permissions and content of each file, so bundles
+// packed in different environments can be compared. Timestamps and ownership
+// are ignored, as is the downloaded image, whose name is random
+func (cp *ShubConveyorPacker) BundleDigest() (string, error) {
+	if cp.b == nil {
+		return "", fmt.Errorf("no bundle to compute digest of")
+	}
+
+	h := sha256.New()
+	err := filepath.Walk(cp.b.Path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == cp.tmpfile {
+			return nil
+		}
+
+		rel, err := filepath.Rel(cp.b.Path, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%v\x00", filepath.ToSlash(rel), fi.Mode())
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			fmt.Fprintf(h, "%d\x00", fi.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not compute bundle digest: %v", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Download an image from Singularity Hub into tmpfile, writing as we
+// download instead of storing in memory
+func (cp *ShubConveyorPacker) fetchImage(ctx context.Context, tmpfile *os.File) (err error) {
+
+	var cacheKey string
+	if cp.Cache != nil {
+		if cacheKey, err = ShubCacheKey(cp.srcURI); err != nil {
+			return err
+		}
+
+		if cached, ok := cp.cachedImage(cacheKey); ok {
+			sylog.Debugf("Using cached image for %s", cp.srcURI.String())
+
+			bytesWritten, err := cp.copyCached(cacheKey, cached, tmpfile)
+			cached.Close()
+			if expected := cp.expectedDigest(); err == nil && expected != "" {
+				err = cp.traceVerifyDigest(ctx, tmpfile.Name(), expected)
+			}
+			if err == nil {
+				cp.tmpfile = tmpfile.Name()
+				cp.downloaded = 0
+				cp.result.Size = bytesWritten
+				cp.result.CacheHit = true
+				sylog.Debugf("Copied %v bytes from cache", bytesWritten)
+				cp.logf("copied %d bytes from cache entry %s", bytesWritten, cacheKey)
+				return cp.lockImage(cp.tmpfile)
+			}
+
+			// a corrupted entry is dropped and replaced by a new download
+			sylog.Warningf("Cached image %s is corrupted, pulling again: %v", cp.srcURI.String(), err)
+			cp.rejectCached(cacheKey)
+			cp.invalidateCache(cacheKey)
+			if err := tmpfile.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := tmpfile.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cp.downloadToFile(ctx, tmpfile, cacheKey)
+}
+
+// pullDir returns the directory the image is downloaded to: a directory
+// unique to this pull within ScratchDir when set, the bundle otherwise
+func (cp *ShubConveyorPacker) pullDir() (string, error) {
+	if cp.ScratchDir == "" {
+		return cp.b.Path, nil
+	}
+
+	if cp.scratch != "" {
+		os.RemoveAll(cp.scratch)
+	}
+
+	dir, err := ioutil.TempDir(cp.ScratchDir, "shub-pull-")
+	if err != nil {
+		return "", fmt.Errorf("could not create scratch directory: %v", err)
+	}
+	cp.scratch = dir
+
+	return dir, nil
+}
+
+// createImageFile creates the temporary file the image is written to in dir
+func (cp *ShubConveyorPacker) createImageFile(dir string) (*os.File, error) {
+	// Create temporary download name
+	tmpfile, err := ioutil.TempFile(dir, "shub-container")
+	if err != nil {
+		return nil, err
+	}
+	sylog.Debugf("\nCreating temporary image file %v\n", tmpfile.Name())
+
+	if cp.FileMode != 0 {
+		if err = chmodWithUmask(tmpfile.Name(), cp.FileMode); err != nil {
+			tmpfile.Close()
+			return nil, fmt.Errorf("could not set image file permissions: %v", err)
+		}
+	}
+
+	return tmpfile, nil
+}
+
+// downloadToFile downloads the image referenced by the manifest into tmpfile,
+// once a download slot is available, verifies it and stores it into the cache
+// under cacheKey when caching is enabled
+func (cp *ShubConveyorPacker) downloadToFile(ctx context.Context, tmpfile *os.File, cacheKey string) (err error) {
+	release, err := acquireDownload(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if cp.CheckAvailability {
+		err = cp.retry(ctx, "Image availability check", func() error {
+			return cp.checkImageAvailable(ctx, filepath.Dir(tmpfile.Name()))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var bytesWritten int64
+	inMemory := false
+	// the response of an image too large for memory is downloaded to file
+	var opened *http.Response
+	if cp.MemoryImageSize > 0 && !cp.Decompress && !cp.SkipSizeCheck {
+		var image []byte
+		err = cp.retry(ctx, "Image download", func() (err error) {
+			image, opened, err = cp.downloadToMemory(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if inMemory = opened == nil; inMemory {
+			if _, err = tmpfile.Write(image); err != nil {
+				return fmt.Errorf("could not write image: %v", err)
+			}
+			bytesWritten = int64(len(image))
+		}
+	}
+
+	chunked := false
+	if !inMemory && opened == nil {
+		if bytesWritten, chunked, err = cp.downloadChunked(ctx, tmpfile); err != nil {
+			return err
+		}
+	}
+
+	if !inMemory && !chunked {
+		if bytesWritten, err = cp.downloadResumable(ctx, tmpfile, opened); err != nil {
+			return err
+		}
+	}
+
+	// a corrupted image is never left behind to be packed or cached
+	if expected := cp.expectedDigest(); expected != "" {
+		if err = cp.traceVerifyDigest(ctx, tmpfile.Name(), expected); err != nil {
+			os.Remove(tmpfile.Name())
+			return err
+		}
+	}
+
+	cp.tmpfile = tmpfile.Name()
+	cp.downloaded = bytesWritten
+	cp.result.Size = bytesWritten
+	cp.logf("downloaded %d bytes, digest %s", bytesWritten, digestOrUnverified(cp.expectedDigest()))
+
+	if err = cp.lockImage(cp.tmpfile); err != nil {
+		return err
+	}
+
+	if cp.Cache != nil {
+		cp.cacheImage(cacheKey)
+	}
+
+	return nil
+}
+
+// checkImageAvailable issues a HEAD request for the image referenced by the
+// manifest and checks its status and announced size, which must fit in dir.
+// Servers not supporting HEAD are left to the download itself
+func (cp *ShubConveyorPacker) checkImageAvailable(ctx context.Context, dir string) error {
+	req, err := http.NewRequest(http.MethodHead, cp.downloadURL(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{
+		Transport:     hostTransport{cp},
+		Timeout:       cp.timeout(req.URL.Hostname()),
+		CheckRedirect: cp.checkRedirect,
+	}
+
+	cp.setHeaders(req)
+	cp.setAuth(req)
+	if err := cp.throttle(ctx, req.URL.Hostname()); err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return withClockHint(err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		sylog.Debugf("Server doesn't support HEAD requests, skipping availability check")
+		return nil
+	default:
+		return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	if err := cp.checkImageSize(resp.ContentLength); err != nil {
+		return err
+	}
+	if resp.ContentLength > 0 {
+		return checkDiskSpace(dir, resp.ContentLength)
+	}
+	return nil
+}
+
+// checkDiskSpace returns an error when the filesystem holding dir has less
+// than size bytes available
+func checkDiskSpace(dir string, size int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("could not check available disk space: %v", err)
+	}
+
+	if available := int64(st.Bavail) * int64(st.Bsize); available < size {
+		return fmt.Errorf("not enough disk space in %s for image of %v bytes, %v bytes available", dir, size, available)
+	}
+	return nil
+}
+
+// downloadResumable downloads the image referenced by the manifest into
+// tmpfile, through the partial download of PartialDir when set so a later
+// pull resumes it if interrupted. The first attempt reads the response
+// opened, when not nil
+func (cp *ShubConveyorPacker) downloadResumable(ctx context.Context, tmpfile *os.File, opened *http.Response) (n int64, err error) {
+	dst := tmpfile
+	if cp.PartialDir != "" {
+		if dst, err = cp.openPartial(); err != nil {
+			if opened != nil {
+				opened.Body.Close()
+			}
+			return 0, err
+		}
+		defer dst.Close()
+	}
+
+	err = cp.retry(ctx, "Image download", func() (err error) {
+		n, err = cp.downloadOpened(ctx, dst, opened)
+		opened = nil
+		return err
+	})
+	if dst == tmpfile {
+		return n, err
+	}
+
+	if err != nil {
+		// only interrupted downloads are worth resuming
+		if cp.retryable(err) || ctx.Err() != nil {
+			cp.savePartial(dst)
+		} else {
+			cp.removePartial()
+		}
+		return n, err
+	}
+	return n, cp.finishPartial(dst, tmpfile)
+}
+
+// downloadImage writes the image referenced by the manifest into dst and
+// returns the number of bytes received. Content left by a previous attempt
+// interrupted mid-stream is resumed when the server supports range requests
+// and identified the image by its ETag or Last-Modified date, and replaced
+// otherwise
+func (cp *ShubConveyorPacker) downloadImage(ctx context.Context, dst *os.File) (int64, error) {
+	return cp.downloadOpened(ctx, dst, nil)
+}
+
+// downloadOpened is downloadImage reading opened, the response of a request
+// for the whole image already sent, instead of sending a new request. It is
+// closed in any case, and only used when there is no content to resume
+func (cp *ShubConveyorPacker) downloadOpened(ctx context.Context, dst *os.File, opened *http.Response) (int64, error) {
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		if opened != nil {
+			opened.Body.Close()
+		}
+		return 0, err
+	}
+	// decompressed content can't be resumed from the compressed stream
+	if cp.Decompress {
+		offset = 0
+	}
+	// without validator, the image could have changed since the partial
+	// content was received and can't be resumed safely
+	if offset > 0 && cp.etag == "" && cp.lastModified == "" {
+		sylog.Infof("Partial download of %s can't be validated, restarting image download", cp.srcURI.String())
+		offset = 0
+	}
+	if opened != nil && offset > 0 {
+		opened.Body.Close()
+		opened = nil
+	}
+
+	resp := opened
+	if resp == nil {
+		if resp, err = cp.openImage(ctx, offset); err != nil {
+			return 0, err
+		}
+	}
+	defer resp.Body.Close()
+	if cp.partial == dst.Name() {
+		cp.savePartial(dst)
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		sylog.Infof("Resuming image download from byte %v", offset)
+	} else {
+		if offset > 0 {
+			sylog.Infof("Server doesn't support resuming downloads, restarting image download")
+		}
+		offset = 0
+		if err := dst.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err := dst.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	expected := resp.ContentLength
+	if expected >= 0 {
+		expected += offset
+	}
+
+	// Write the body to file, sizes are checked against the bytes received,
+	// before decompression. Servers not reporting a length can't exceed the
+	// maximum size either
+	checker := newSizeCheckingWriter(dst, expected, cp.MaxImageSize)
+	checker.n = offset
+	received, stop := cp.watchStall(resp.Body)
+	defer stop()
+	var w io.Writer = checker
+	body := received
+	if cp.Decompress {
+		checker.w = ioutil.Discard
+		w = dst
+		if body, err = decompressReader(io.TeeReader(received, checker)); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err = io.Copy(w, body); err != nil {
+		return checker.Written(), err
+	}
+
+	bytesWritten := checker.Written()
+	if bytesWritten == 0 {
+		return 0, fmt.Errorf("received an empty image")
+	}
+	if err = checkNotHTML(dst); err != nil {
+		return bytesWritten, err
+	}
+
+	// Simple check to make sure image received is the correct size. Servers
+	// may omit the length and close the connection to signal the end of the
+	// image (ContentLength is -1), a clean EOF is then taken as complete
+	if cp.SkipSizeCheck {
+		sylog.Warningf("Size check disabled, received %v bytes for announced size %v", bytesWritten, expected)
+	} else if err = checker.Verify(); err != nil {
+		return bytesWritten, err
+	}
+
+	return bytesWritten, nil
+}
+
+// downloadToMemory downloads the image referenced by the manifest into memory
+// when the registry announces a size within MemoryImageSize, and checks it
+// before it is written anywhere. When the image has to be downloaded to a
+// file instead, the response is returned unread to be written there
+func (cp *ShubConveyorPacker) downloadToMemory(ctx context.Context) ([]byte, *http.Response, error) {
+	resp, err := cp.openImage(ctx, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.ContentLength <= 0 || resp.ContentLength > cp.MemoryImageSize {
+		sylog.Debugf("Image size %v isn't within memory download limit %v, downloading to file", resp.ContentLength, cp.MemoryImageSize)
+		return nil, resp, nil
+	}
+	defer resp.Body.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
+	checker := newSizeCheckingWriter(buf, resp.ContentLength, resp.ContentLength)
+	body, stop := cp.watchStall(resp.Body)
+	defer stop()
+	if _, err := io.Copy(checker, body); err != nil {
+		return nil, nil, err
+	}
+	if err := checker.Verify(); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNotHTML(bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), nil, nil
+}
+
+// downloadURL returns the URL the image is downloaded from, the one of the
+// manifest unless rewritten
+func (cp *ShubConveyorPacker) downloadURL() string {
+	if cp.imageURL != "" {
+		return cp.imageURL
+	}
+	return cp.manifest.Image
+}
+
+// requestImage sends a request for the image referenced by the manifest,
+// restricted to byteRange when not empty, unless the image no longer matches
+// the ifRange entity tag
+func (cp *ShubConveyorPacker) requestImage(ctx context.Context, method, byteRange, ifRange string) (*http.Response, error) {
+	req, err := cp.newImageRequest(method, byteRange, ifRange)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{
+		Transport:     hostTransport{cp},
+		CheckRedirect: cp.checkRedirect,
+	}
+	if err := cp.throttle(ctx, req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cp.logf("%s %s: %v", method, redactURL(req.URL.String()), err)
+		return nil, withClockHint(err)
+	}
+	cp.logf("%s %s: %s", method, redactURL(req.URL.String()), resp.Status)
+
+	return resp, nil
+}
+
+// newImageRequest creates the request for the image referenced by the manifest
+func (cp *ShubConveyorPacker) newImageRequest(method, byteRange, ifRange string) (*http.Request, error) {
+	req, err := http.NewRequest(method, cp.downloadURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	cp.setHeaders(req)
+	cp.setAuth(req)
+	return req, nil
+}
+
+// openImage requests the image referenced by the manifest, from byte offset
+// when not 0, and checks the response before the body is read. Servers not
+// supporting range requests, or whose image changed, answer with the whole image
+func (cp *ShubConveyorPacker) openImage(ctx context.Context, offset int64) (*http.Response, error) {
+	var byteRange, ifRange string
+	if offset > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-", offset)
+		ifRange = cp.etag
+		if ifRange == "" {
+			ifRange = cp.lastModified
+		}
+	}
+
+	// Get the image based on the manifest
+	resp, err := cp.requestImage(ctx, http.MethodGet, byteRange, ifRange)
+	if err != nil {
+		return nil, err
+	}
+	// weak validators can't guard range requests
+	if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		cp.etag = etag
+	}
+	cp.lastModified = resp.Header.Get("Last-Modified")
+
+	size := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if size >= 0 {
+			size += offset
+		}
+	default:
+		resp.Body.Close()
+		return nil, &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		resp.Body.Close()
+		return nil, fmt.Errorf("received an HTML page instead of an image")
+	}
+
+	if err = cp.checkImageSize(size); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// checkRedirect restricts the hosts image requests are redirected to when
+// RedirectHosts is set
+func (cp *ShubConveyorPacker) checkRedirect(req *http.Request, via []*http.Request) error {
+	if err := cp.redirectHeaders(req, via); err != nil {
+		return err
+	}
+	if len(cp.RedirectHosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, allowed := range cp.RedirectHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("redirect to disallowed host %s", host)
+}
+
+// checkNotHTML returns an error when the content written to f looks like an
+// HTML page, as served by some proxies and storage backends on errors
+func checkNotHTML(f io.ReaderAt) error {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if strings.HasPrefix(http.DetectContentType(head[:n]), "text/html") {
+		return fmt.Errorf("received an HTML page instead of an image")
+	}
+	return nil
+}
+
+// cachedImage returns the cached image stored under key, unless the version
+// recorded along with it differs from the manifest one, in which case the
+// image is pulled again. Entries without recorded version are always used
+func (cp *ShubConveyorPacker) cachedImage(key string) (io.ReadCloser, bool) {
+	cached, ok := cp.Cache.Get(key)
+	if ok && !cp.cachedDigestMatches(key) {
+		sylog.Infof("Cached image %s doesn't match digest %s, pulling again", cp.srcURI.String(), cp.srcURI.digest)
+		cached.Close()
+		cp.rejectCached(key)
+		return nil, false
+	}
+	if !ok || cp.manifest == nil || cp.manifest.Version == "" {
+		return cached, ok
+	}
+
+	r, ok := cp.Cache.Get(versionKey(key))
+	if !ok {
+		return cached, true
+	}
+	defer r.Close()
+
+	version, err := ioutil.ReadAll(r)
+	if err != nil || string(version) == cp.manifest.Version {
+		return cached, true
+	}
+
+	sylog.Infof("Image %s changed from version %s to %s, pulling again", cp.srcURI.String(), version, cp.manifest.Version)
+	cached.Close()
+	cp.rejectCached(key)
+	cp.result.Repulled = true
+	return nil, false
 }
 
-// ShubConveyorPacker only needs to hold the conveyor to have the needed data to pack
-type ShubConveyorPacker struct {
-	recipe   sytypes.Definition
-	srcURI   ShubURI
-	tmpfile  string
-	manifest *shubAPIResponse
-	b        *sytypes.Bundle
-	localPacker
+// rejectCached reports to the cache that the entry it returned for key isn't
+// used, when the cache supports it, so the lookup counts as a miss
+func (cp *ShubConveyorPacker) rejectCached(key string) {
+	if rc, ok := cp.Cache.(interface {
+		Reject(string)
+	}); ok {
+		rc.Reject(key)
+	}
 }
 
-// Get downloads container from Singularityhub
-func (cp *ShubConveyorPacker) Get(recipe sytypes.Definition) (err error) {
-	sylog.Debugf("Getting container from Shub")
+// cachedDigestMatches compares the md5 digest of the reference, if any, with
+// the digest recorded by the cache for key, without reading the cached image.
+// Caches not recording digests are trusted
+func (cp *ShubConveyorPacker) cachedDigestMatches(key string) bool {
+	if cp.srcURI.digest == "" {
+		return true
+	}
 
-	cp.recipe = recipe
+	dc, ok := cp.Cache.(interface {
+		Digest(string) (string, bool)
+	})
+	if !ok {
+		return true
+	}
 
-	src := `//` + recipe.Header["from"]
+	// caches record md5 digests, other algorithms are verified once copied
+	alg, sum, err := parseDigest(strings.TrimPrefix(cp.srcURI.digest, `@`))
+	if err != nil || alg != "md5" {
+		return true
+	}
 
-	//use custom parser to make sure we have a valid shub URI
-	cp.srcURI, err = ShubParseReference(src)
+	digest, ok := dc.Digest(key)
+	return !ok || digest == sum
+}
+
+// copyCached copies the cached image to dst, checking its integrity against
+// the digest recorded by the cache, if any, while copying
+func (cp *ShubConveyorPacker) copyCached(key string, cached io.Reader, dst io.Writer) (int64, error) {
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), cached)
 	if err != nil {
-		sylog.Fatalf("Invalid shub URI: %v", err)
+		return n, fmt.Errorf("could not read cached image: %v", err)
+	}
+
+	if dc, ok := cp.Cache.(interface {
+		Digest(string) (string, bool)
+	}); ok {
+		expected, ok := dc.Digest(key)
+		if actual := hex.EncodeToString(h.Sum(nil)); ok && actual != expected {
+			return n, fmt.Errorf("cached image digest %s doesn't match recorded digest %s", actual, expected)
+		}
+	}
+
+	return n, nil
+}
+
+// invalidateCache removes the entry stored under key, when the cache supports it
+func (cp *ShubConveyorPacker) invalidateCache(key string) {
+	rc, ok := cp.Cache.(interface {
+		Remove(string) error
+	})
+	if !ok {
 		return
 	}
 
-	//create bundle to build into
-	cp.b, err = sytypes.NewBundle("sbuild-shub")
+	if err := rc.Remove(key); err != nil {
+		sylog.Warningf("Unable to remove cache entry %s: %v", key, err)
+	}
+}
+
+// PurgeCache removes the image cached for the reference ref, as written in
+// the From: header of definitions, from the Cache, which must support
+// removing entries
+func (cp *ShubConveyorPacker) PurgeCache(ref string) error {
+	uri, err := ValidateReference(ref)
+	if err != nil {
+		return err
+	}
+	if cp.Cache == nil {
+		return fmt.Errorf("no cache configured")
+	}
+
+	if fc, ok := cp.Cache.(interface {
+		Purge(ShubURI) error
+	}); ok {
+		return fc.Purge(uri)
+	}
+
+	rc, ok := cp.Cache.(interface {
+		Remove(string) error
+	})
+	if !ok {
+		return fmt.Errorf("cache %T doesn't support removing entries", cp.Cache)
+	}
+	key, err := ShubCacheKey(uri)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{key, versionKey(key)} {
+		if err := rc.Remove(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionKeyPrefix prefixes the cache keys recording the version of cached images
+const versionKeyPrefix = "shub-version/"
+
+// versionKey returns the cache key recording the version of the image cached under key
+func versionKey(key string) string {
+	return versionKeyPrefix + strings.TrimPrefix(key, "shub/")
+}
+
+// cacheImage stores the downloaded image into the cache. Failing to cache
+// isn't fatal to the build, so errors are only reported
+func (cp *ShubConveyorPacker) cacheImage(key string) {
+	f, err := os.Open(cp.tmpfile)
 	if err != nil {
+		sylog.Warningf("Unable to cache image: %v", err)
 		return
 	}
+	defer f.Close()
 
-	// Get the image manifest
-	if err = cp.getManifest(); err != nil {
-		sylog.Fatalf("Failed to get manifest from Shub: %v", err)
+	if err := cp.Cache.Put(key, f); err != nil {
+		sylog.Warningf("Unable to cache image: %v", err)
 		return
 	}
 
-	// retrieve the image
-	if err = cp.fetchImage(); err != nil {
-		sylog.Fatalf("Failed to get image from Shub: %v", err)
+	if cp.manifest != nil && cp.manifest.Version != "" {
+		if err := cp.Cache.Put(versionKey(key), strings.NewReader(cp.manifest.Version)); err != nil {
+			sylog.Warningf("Unable to record version of cached image: %v", err)
+		}
+	}
+
+	if cp.OnCachePut == nil {
 		return
 	}
 
-	cp.localPacker, err = getLocalPacker(cp.tmpfile, cp.b)
+	var path string
+	if fc, ok := cp.Cache.(interface {
+		Path(string) (string, error)
+	}); ok {
+		path, _ = fc.Path(key)
+	}
 
-	return err
+	if err := cp.OnCachePut(key, path); err != nil {
+		sylog.Warningf("Cache population callback failed for %s: %v", key, err)
+	}
 }
 
-// Download an image from Singularity Hub, writing as we download instead
-// of storing in memory
-func (cp *ShubConveyorPacker) fetchImage() (err error) {
+// BytesDownloaded returns the number of bytes transferred by the last
+// successful image download in Get
+func (cp *ShubConveyorPacker) BytesDownloaded() int64 {
+	return cp.downloaded
+}
 
-	// Create temporary download name
-	tmpfile, err := ioutil.TempFile(cp.b.Path, "shub-container")
-	sylog.Debugf("\nCreating temporary image file %v\n", tmpfile.Name())
-	if err != nil {
-		return err
+// checkImageSize rejects an image whose announced size falls outside of the
+// configured bounds. An unknown size (-1) is only checked during the download
+func (cp *ShubConveyorPacker) checkImageSize(size int64) error {
+	if size < 0 {
+		return nil
 	}
-	defer tmpfile.Close()
+	if cp.MinImageSize > 0 && size < cp.MinImageSize {
+		return fmt.Errorf("image size of %v bytes is below the minimum size of %v bytes", size, cp.MinImageSize)
+	}
+	if cp.MaxImageSize > 0 && size > cp.MaxImageSize {
+		return fmt.Errorf("image size of %v bytes exceeds the maximum size of %v bytes", size, cp.MaxImageSize)
+	}
+	return nil
+}
 
-	// Get the image based on the manifest
-	resp, err := http.Get(cp.manifest.Image)
+// getManifestByDigest resolves a reference holding a digest. The digest alone
+// identifies the image so the manifest is requested without the tag, which is
+// then only checked against the tag reported by the manifest: a mismatch is
+// reported but doesn't fail the build, and tag fallbacks don't apply
+func (cp *ShubConveyorPacker) getManifestByDigest(ctx context.Context, base ShubURI) error {
+	uri := base
+	uri.tag = ""
+
+	err := cp.retry(ctx, "Manifest request", func() error {
+		return cp.requestManifest(ctx, uri)
+	})
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	// Write the body to file
-	bytesWritten, err := io.Copy(tmpfile, resp.Body)
+	tag := strings.TrimPrefix(base.tag, `:`)
+	if tag != "" && cp.manifest.Tag != "" && cp.manifest.Tag != tag {
+		sylog.Warningf("Image %s has tag %s, not the requested tag %s", uri.String(), cp.manifest.Tag, tag)
+	}
+
+	return nil
+}
+
+// errManifestNotFound is returned when the registry has no manifest for a reference
+var errManifestNotFound = errors.New("manifest not found")
+
+// getManifest will return the image manifest for a container uri
+// from Singularity Hub. When the primary registry fails, each mirror is
+// tried in order. References holding both a tag and a digest are resolved by
+// digest, the tag being only verified
+func (cp *ShubConveyorPacker) getManifest(ctx context.Context) (err error) {
+	uris, err := cp.registries()
 	if err != nil {
 		return err
 	}
-	//Simple check to make sure image received is the correct size
-	if bytesWritten != resp.ContentLength {
-		return fmt.Errorf("Image received is not the right size. Supposed to be: %v  Actually: %v", resp.ContentLength, bytesWritten)
+
+	for i, uri := range uris {
+		err = cp.getManifestFrom(ctx, uri)
+		if err == nil {
+			if i > 0 {
+				sylog.Infof("Using manifest from mirror %s for %s", uri.registry, cp.srcURI.String())
+			}
+			return nil
+		}
+		if i < len(uris)-1 {
+			sylog.Warningf("Manifest request to %s failed: %v, trying mirror %s", uri.registry, err, uris[i+1].registry)
+		}
 	}
 
-	cp.tmpfile = tmpfile.Name()
-	return nil
+	return err
 }
 
-// getManifest will return the image manifest for a container uri
-// from Singularity Hub. We return the shubAPIResponse and error
-func (cp *ShubConveyorPacker) getManifest() (err error) {
+// registries returns the reference on each registry the manifest is requested
+// from, the primary one first followed by the mirrors in order, without duplicates
+func (cp *ShubConveyorPacker) registries() ([]ShubURI, error) {
+	uris := []ShubURI{cp.srcURI}
+	seen := map[string]bool{cp.srcURI.registry: true}
 
-	// Create a new Singularity Hub client
-	sc := http.Client{
-		Timeout: 30 * time.Second,
+	for _, mirror := range cp.Mirrors {
+		if mirror = strings.TrimSpace(mirror); mirror == "" {
+			continue
+		}
+
+		uri, err := NewShubURI(mirror, cp.srcURI.user, cp.srcURI.container, cp.srcURI.tag, cp.srcURI.digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror %q: %v", mirror, err)
+		}
+		uri.file = cp.srcURI.file
+		if seen[uri.registry] {
+			continue
+		}
+		seen[uri.registry] = true
+		uris = append(uris, uri)
 	}
 
-	//if we are using a non default registry error out for now
-	if !cp.srcURI.defaultReg {
-		return err
+	if len(uris) > 1 {
+		names := make([]string, len(uris))
+		for i, uri := range uris {
+			names[i] = uri.registry
+		}
+		sylog.Debugf("Requesting manifest from registries in order: %s", strings.Join(names, ", "))
 	}
 
-	// Format the http address, coinciding with the image uri
-	httpAddr := fmt.Sprintf("www.%s", cp.srcURI.String())
+	return uris, nil
+}
 
-	// Create the request, add headers context
-	url := url.URL{
-		Scheme: "https",
-		Host:   strings.Split(httpAddr, `/`)[0],     //split url to match format, first half
-		Path:   strings.SplitN(httpAddr, `/`, 2)[1], //second half
+// getManifestFrom requests the manifest of base from its registry, trying
+// the fallback tags in order when the requested tag doesn't exist
+func (cp *ShubConveyorPacker) getManifestFrom(ctx context.Context, base ShubURI) (err error) {
+	if base.digest != "" {
+		return cp.getManifestByDigest(ctx, base)
 	}
 
-	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	uris := cp.manifestCandidates(base)
+	for i, uri := range uris {
+		uri := uri
+		err = cp.retry(ctx, "Manifest request", func() error {
+			return cp.requestManifest(ctx, uri)
+		})
+		if err == errManifestNotFound && i < len(uris)-1 {
+			sylog.Infof("No manifest found for %s, trying fallback tag %s", uri.String(), uris[i+1].tag)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			sylog.Infof("Using fallback tag %s for %s", uri.tag, cp.srcURI.String())
+			cp.srcURI.tag = uri.tag
+		}
+		return nil
+	}
+
+	return err
+}
+
+// removedError reports that the container of uri was removed from its
+// registry, suggesting the AlternativeRegistry when configured
+func (cp *ShubConveyorPacker) removedError(uri ShubURI) error {
+	msg := fmt.Sprintf("container %s has been removed or deprecated on the registry", uri.String())
+	if cp.AlternativeRegistry != "" {
+		msg += fmt.Sprintf(", it may still be available from registry %s", cp.AlternativeRegistry)
+	}
+	return errors.New(msg)
+}
+
+// requestManifest fetches the manifest for uri into cp.manifest
+func (cp *ShubConveyorPacker) requestManifest(ctx context.Context, uri ShubURI) (err error) {
+
+	// Create a new client for the registry or mirror of uri
+	manifestURL := cp.manifestURL(uri)
+	sc := http.Client{
+		Transport:     hostTransport{cp},
+		Timeout:       cp.timeout(manifestURL.Hostname()),
+		CheckRedirect: cp.redirectHeaders,
+	}
+
+	// Create the request, add headers context
+	req, err := cp.newManifestRequest(uri)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", useragent.Value)
+	if err := cp.throttle(ctx, req.URL.Hostname()); err != nil {
+		return err
+	}
 
 	// Do the request, if status isn't success, return error
-	res, err := sc.Do(req)
+	res, err := sc.Do(req.WithContext(ctx))
 	sylog.Debugf("response: %v\n", res)
 
 	if err != nil {
-		return err
+		cp.logf("GET %s: %v", manifestURL.String(), err)
+		return withClockHint(err)
 	}
+	cp.logf("GET %s: %s", manifestURL.String(), res.Status)
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotFound {
+		return errManifestNotFound
+	}
+	if res.StatusCode == http.StatusGone {
+		return cp.removedError(uri)
+	}
 	if res.StatusCode != http.StatusOK {
-		err = errors.New(res.Status)
-		return err
+		return &httpStatusError{code: res.StatusCode, status: res.Status}
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
@@ -178,38 +1851,166 @@ func (cp *ShubConveyorPacker) getManifest() (err error) {
 		return err
 	}
 
+	// registries may give the image relative to the manifest
+	image, err := resolveImageURL(manifestURL, cp.manifest.Image)
+	if err != nil {
+		return err
+	}
+	if image != cp.manifest.Image {
+		sylog.Debugf("Resolved relative image URL %s to %s", cp.manifest.Image, redactURL(image))
+		cp.manifest.Image = image
+	}
+
 	return nil
 }
 
+// resolveImageURL resolves the image URL of a manifest against the address
+// the manifest was received from, when relative
+func resolveImageURL(base url.URL, image string) (string, error) {
+	u, err := url.Parse(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image URL in manifest: %v", err)
+	}
+	if u.IsAbs() || image == "" {
+		return image, nil
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+// newManifestRequest creates the request for the manifest of uri
+func (cp *ShubConveyorPacker) newManifestRequest(uri ShubURI) (*http.Request, error) {
+	manifestURL := cp.manifestURL(uri)
+	req, err := http.NewRequest(http.MethodGet, manifestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", useragent.Value)
+	req.Header.Set("Accept", cp.manifestAccept())
+	cp.setHeaders(req)
+	cp.setAuth(req)
+	return req, nil
+}
+
+// manifestAccept returns the Accept header of manifest requests
+func (cp *ShubConveyorPacker) manifestAccept() string {
+	if cp.ManifestAccept != "" {
+		return cp.ManifestAccept
+	}
+	return defaultManifestAccept
+}
+
+// apiURL returns the registry API address coinciding with the image uri.
+// The default registry is served from its www host
+func apiURL(uri ShubURI) url.URL {
+	// the manifest describes all the files of the container
+	uri.file = ""
+	httpAddr := uri.String()
+	if uri.defaultReg {
+		httpAddr = fmt.Sprintf("www.%s", httpAddr)
+	}
+
+	//split url to match format, host first and path second
+	pieces := strings.SplitN(httpAddr, `/`, 2)
+	u := url.URL{
+		Scheme: "https",
+		Host:   pieces[0],
+	}
+	if len(pieces) == 2 {
+		u.Path = pieces[1]
+	}
+	return u
+}
+
+// ReferenceError is returned by ValidateReference for malformed references
+type ReferenceError struct {
+	// Reference is the reference as given
+	Reference string
+	// Err describes what is wrong with it
+	Err error
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("invalid shub reference %q: %v", e.Reference, e.Err)
+}
+
+// ValidateReference checks that ref is a well formed shub reference, as
+// written in the From: header of definitions or on the command line, without
+// any network access. Surrounding spaces, the shub:// scheme and leading
+// slashes are accepted. Malformed references return a *ReferenceError
+func ValidateReference(ref string) (ShubURI, error) {
+	src := strings.TrimSpace(ref)
+	if i := strings.Index(src, "://"); i >= 0 && src[:i] != "shub" {
+		return ShubURI{}, &ReferenceError{Reference: ref, Err: fmt.Errorf("scheme %s isn't shub", src[:i])}
+	}
+	src = strings.TrimPrefix(strings.TrimPrefix(src, "shub:"), `//`)
+
+	uri, err := ShubParseReference(`//` + src)
+	if err != nil {
+		return ShubURI{}, &ReferenceError{Reference: ref, Err: err}
+	}
+	return uri, nil
+}
+
 // ShubParseReference accepts a URI string and parses its content
 // It will return an error if the given URI is not valid,
 // otherwise it will parse the contents into a ShubURI struct
 func ShubParseReference(src string) (uri ShubURI, err error) {
 
-	//define regex for each URI component
-	registryRegexp := `([-a-zA-Z0-9/]{1,64}\/)?` //target is very open, outside registry
-	nameRegexp := `([-a-zA-Z0-9]{1,39}\/)`       //target valid github usernames
-	containerRegexp := `([-_.a-zA-Z0-9]{1,64})`  //target valid github repo names
-	tagRegexp := `(:[-_.a-zA-Z0-9]{1,64})?`      //target is very open, file extensions or branch names
-	digestRegexp := `(\@[a-f0-9]{32})?`          //target md5 sum hash
-
 	//expression is anchored
 	shubRegex, err := regexp.Compile(`^\/\/` + registryRegexp + nameRegexp + containerRegexp + tagRegexp + digestRegexp + `$`)
 	if err != nil {
 		return uri, err
 	}
 
+	//apply the default user to references made of the container alone,
+	//whatever the slashes of the tag and file
+	name := src
+	if i := strings.IndexAny(name, `:@#`); i >= 0 {
+		name = name[:i]
+	}
+	if user := os.Getenv(shubDefaultUserEnv); user != "" && strings.HasPrefix(name, `//`) && !strings.Contains(name[2:], `/`) && src != `//` {
+		sylog.Infof("Using default user %s for %s", user, src[2:])
+		src = `//` + strings.TrimSuffix(user, `/`) + `/` + src[2:]
+	}
+
+	//a file selector ends the reference, it is split first so slashes
+	//within it aren't taken for registry levels
+	if i := strings.Index(src, `#`); i >= 0 {
+		if err := validateComponent("file", src[i:], fileRegexp); err != nil {
+			return uri, fmt.Errorf("Source string is not a valid URI: %s, expected %s: %v", src, shubReferenceFormat, err)
+		}
+		uri.file = src[i:]
+		src = src[:i]
+	}
+
 	found := shubRegex.FindString(src)
 
 	//sanity check
-	//if found string is not equal to the input, input isn't a valid URI
-	if strings.Compare(src, found) != 0 {
-		return uri, fmt.Errorf("Source string is not a valid URI: %s", src)
+	//if found string is not equal to the input, input isn't a valid URI.
+	//no match is an empty string too, which an empty input would equal
+	if found == "" || strings.Compare(src, found) != 0 {
+		return uri, fmt.Errorf("Source string is not a valid URI: %s, expected %s%s", src, shubReferenceFormat, shubReferenceHint(src))
 	}
 
 	//strip `//` from start of src
 	src = src[2:]
 
+	//the tag is taken verbatim up to the digest, so slashes within it
+	//aren't taken for registry levels either
+	name = src
+	if i := strings.Index(name, `@`); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.Index(name, `:`); i >= 0 {
+		uri.tag = name[i:]
+		src = name[:i] + src[len(name):]
+	}
+
+	//consecutive slashes would produce empty pieces when splitting below
+	if strings.HasPrefix(src, `/`) || strings.Contains(src, `//`) {
+		return uri, fmt.Errorf("Source string contains an empty path segment: %s", `//`+src)
+	}
+
 	pieces := strings.SplitAfterN(src, `/`, -1)
 	if l := len(pieces); l > 2 {
 		//more than two pieces indicates a custom registry
@@ -217,6 +2018,12 @@ func ShubParseReference(src string) (uri ShubURI, err error) {
 		uri.registry = strings.Join(pieces[:l-2], "")
 		uri.user = pieces[l-2]
 		src = pieces[l-1]
+
+		//a fully qualified default registry is still the default registry
+		if isDefaultRegistry(uri.registry) {
+			uri.defaultReg = true
+			uri.registry = defaultRegistry
+		}
 	} else if l == 2 {
 		//two pieces means default registry
 		uri.defaultReg = true
@@ -232,24 +2039,276 @@ func ShubParseReference(src string) (uri ShubURI, err error) {
 		src = pieces[0]
 	}
 
-	//look for a : and split if it exists
-	if strings.Contains(src, `:`) {
-		pieces = strings.Split(src, `:`)
-		uri.tag = `:` + pieces[1]
-		src = pieces[0]
-	}
-
 	//container name is left over after other parts are split from it
 	uri.container = src
 
+	if err = uri.Validate(); err != nil {
+		return uri, err
+	}
+
+	sylog.Debugf("Parsed shub URI %s: registry=%q user=%q container=%q tag=%q file=%q digest=%q defaultReg=%v",
+		uri.String(), uri.registry, uri.user, uri.container, uri.tag, uri.file, uri.digest, uri.defaultReg)
 	return uri, nil
 }
 
+// ShubParseReferenceURLEncoded parses a reference passed URL-encoded, e.g.
+// from a query parameter, where separators may be written %40 for @ or %3A
+// for :
+func ShubParseReferenceURLEncoded(src string) (ShubURI, error) {
+	decoded, err := url.PathUnescape(src)
+	if err != nil {
+		return ShubURI{}, fmt.Errorf("Source string is not a valid URL-encoded URI: %s: %v", src, err)
+	}
+	return ShubParseReference(decoded)
+}
+
+// shubReferenceFormat describes the accepted form of shub references
+const shubReferenceFormat = `[registry/]user/container[:tag][@digest][#file]`
+
+// shubReferenceHint guesses why src isn't a valid reference, returning an
+// empty string when there is no obvious reason
+func shubReferenceHint(src string) string {
+	ref := strings.TrimPrefix(src, `//`)
+	name := ref
+	if i := strings.IndexAny(name, `:@`); i >= 0 {
+		name = name[:i]
+	}
+
+	switch {
+	case ref == "":
+		return " (reference is empty)"
+	case strings.Contains(ref, "://"):
+		return " (reference must not include a scheme)"
+	case !strings.Contains(name, `/`):
+		return " (missing user, e.g. user/" + name + ", or set " + shubDefaultUserEnv + ")"
+	case strings.HasSuffix(name, `/`):
+		return " (missing container name)"
+	case strings.HasSuffix(ref, `:`):
+		return " (empty tag)"
+	case strings.HasSuffix(ref, `@`):
+		return " (empty digest)"
+	case strings.Contains(ref, `@`):
+		return " (digest must be an md5 sum, or a sha256 or sha512 sum prefixed by its algorithm, of lowercase hexadecimal characters)"
+	}
+	return ""
+}
+
+// isDefaultRegistry reports whether registry, with its trailing slash, names
+// the default registry, optionally with the `www.` prefix of its API host
+func isDefaultRegistry(registry string) bool {
+	pieces := strings.SplitN(registry, `/`, 2)
+	host := strings.TrimPrefix(strings.ToLower(pieces[0]), "www.")
+	if len(pieces) == 2 {
+		host += `/` + pieces[1]
+	}
+	return host == defaultRegistry
+}
+
+// NewShubURI creates a ShubURI from its individual components. An empty
+// registry selects the default registry. Separators (trailing `/` on the
+// registry and user, leading `:` on the tag and `@` on the digest) are
+// optional and added when missing
+func NewShubURI(registry, user, container, tag, digest string) (uri ShubURI, err error) {
+	registry = strings.TrimSuffix(registry, `/`)
+	if registry == "" || isDefaultRegistry(registry+`/`) {
+		uri.defaultReg = true
+		uri.registry = defaultRegistry
+	} else {
+		uri.registry = registry + `/`
+	}
+
+	uri.user = strings.TrimSuffix(user, `/`) + `/`
+	uri.container = container
+
+	if tag = strings.TrimPrefix(tag, `:`); tag != "" {
+		uri.tag = `:` + tag
+	}
+
+	if digest = strings.TrimPrefix(digest, `@`); digest != "" {
+		uri.digest = `@` + digest
+	}
+
+	return uri, uri.Validate()
+}
+
+// Validate checks each component of the ShubURI against its constraints
+// and returns a descriptive error for the first one that is not valid
+func (s *ShubURI) Validate() error {
+	if s.defaultReg && s.registry != defaultRegistry {
+		return fmt.Errorf("registry %q does not match the default registry %q", s.registry, defaultRegistry)
+	}
+	if !s.defaultReg {
+		if s.registry == "" {
+			return fmt.Errorf("registry is required when not using the default registry")
+		}
+		if err := validateComponent("registry", s.registry, registryRegexp); err != nil {
+			return err
+		}
+		if strings.HasPrefix(s.registry, "/") {
+			return fmt.Errorf("registry %q is missing a host", s.registry)
+		}
+		if strings.Contains(s.registry, "//") {
+			return fmt.Errorf("registry %q contains an empty path segment", s.registry)
+		}
+		if strings.Contains(s.registry, "..") {
+			return fmt.Errorf("registry %q contains an invalid path segment", s.registry)
+		}
+	}
+
+	if err := validateComponent("user", s.user, nameRegexp); err != nil {
+		return err
+	}
+	if err := validateComponent("container", s.container, containerRegexp); err != nil {
+		return err
+	}
+	if err := validateComponent("tag", s.tag, tagRegexp); err != nil {
+		return err
+	}
+	if strings.Contains(s.tag, `/`) {
+		if err := validateSegments("tag", s.tag, strings.TrimPrefix(s.tag, `:`)); err != nil {
+			return err
+		}
+	}
+
+	if err := validateComponent("digest", s.digest, digestRegexp); err != nil {
+		return err
+	}
+	if s.file != "" {
+		if err := validateComponent("file", s.file, fileRegexp); err != nil {
+			return err
+		}
+		if err := validateSegments("file", s.file, strings.TrimPrefix(s.file, `#`)); err != nil {
+			return err
+		}
+	}
+	if s.digest != "" {
+		if _, _, err := parseDigest(strings.TrimPrefix(s.digest, `@`)); err != nil {
+			return fmt.Errorf("invalid digest %q in shub URI: %v", s.digest, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateReserved rejects user and container names colliding with the API
+// paths of known registries. It isn't part of Validate, as existing
+// references may use such names
+func (s *ShubURI) ValidateReserved() error {
+	reserved := reservedNames[s.registry]
+	for _, name := range reserved.users {
+		if strings.EqualFold(strings.TrimSuffix(s.user, "/"), name) {
+			return fmt.Errorf("user %q is reserved by registry %s", name, s.registry)
+		}
+	}
+	for _, name := range reserved.containers {
+		if strings.EqualFold(s.container, name) {
+			return fmt.Errorf("container %q is reserved by registry %s", name, s.registry)
+		}
+	}
+
+	return nil
+}
+
+// validateSegments rejects empty, `.` and `..` segments of the slash
+// separated path of component value
+func validateSegments(name, value, path string) error {
+	for _, segment := range strings.Split(path, `/`) {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%s %q contains an invalid path segment", name, value)
+		}
+	}
+	return nil
+}
+
+// validateComponent matches a single URI component against its anchored expression
+func validateComponent(name, value, expr string) error {
+	re, err := regexp.Compile(`^` + expr + `$`)
+	if err != nil {
+		return err
+	}
+
+	if !re.MatchString(value) {
+		return fmt.Errorf("invalid %s %q in shub URI, must match %s", name, value, expr)
+	}
+
+	return nil
+}
+
 func (s *ShubURI) String() string {
-	return s.registry + s.user + s.container + s.tag + s.digest
+	return s.registry + s.user + s.container + s.tag + s.digest + s.file
+}
+
+// Canonical returns the fully qualified form of the URI, always including
+// the registry with a lower case host and the tag, which defaults to latest
+func (s *ShubURI) Canonical() string {
+	registry := s.registry
+	if registry == "" {
+		registry = defaultRegistry
+	}
+	pieces := strings.SplitN(registry, `/`, 2)
+	registry = strings.ToLower(pieces[0]) + `/` + pieces[1]
+
+	tag := s.tag
+	if tag == "" {
+		tag = ":latest"
+	}
+
+	return registry + s.user + s.container + tag + s.digest + s.file
+}
+
+// Equal reports whether s and other reference the same image, comparing
+// their canonical forms so formatting differences are ignored
+func (s *ShubURI) Equal(other ShubURI) bool {
+	return s.Canonical() == other.Canonical()
+}
+
+// CompareShubURI orders a and b by their canonical forms, returning -1, 0 or
+// +1 like strings.Compare. It is 0 exactly when a and b are Equal
+func CompareShubURI(a, b ShubURI) int {
+	return strings.Compare(a.Canonical(), b.Canonical())
+}
+
+// Manifest returns a copy of the manifest the reference resolved to, and
+// whether it was resolved yet
+func (cp *ShubConveyorPacker) Manifest() (ShubManifest, bool) {
+	if cp.manifest == nil {
+		return ShubManifest{}, false
+	}
+	return ShubManifest(*cp.manifest), true
+}
+
+// SourceType returns the build source the conveyorPacker retrieves images from
+func (cp *ShubConveyorPacker) SourceType() string {
+	return "shub"
 }
 
-// CleanUp removes any tmpfs owned by the conveyorPacker on the filesystem
+// CleanUp removes any tmpfs owned by the conveyorPacker on the filesystem.
+// A GetContext still in progress is cancelled and waited for first
 func (cp *ShubConveyorPacker) CleanUp() {
-	os.RemoveAll(cp.b.Path)
+	cp.mu.Lock()
+	if cp.cancel != nil {
+		cp.cancel()
+	}
+	cp.mu.Unlock()
+
+	cp.running.Wait()
+
+	// shared transports keep their connections for the other packers
+	if cp.IsolatedTransport {
+		cp.transportMu.Lock()
+		for _, transport := range cp.transports {
+			transport.CloseIdleConnections()
+		}
+		cp.transportMu.Unlock()
+	}
+
+	if cp.scratch != "" {
+		if err := removeTemp(cp.scratch, cp.ScratchDir); err != nil {
+			sylog.Warningf("Could not remove scratch directory: %v", err)
+		}
+	}
+
+	if cp.b != nil {
+		removeBundle(cp.b.Path)
+	}
 }
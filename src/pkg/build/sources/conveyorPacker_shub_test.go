@@ -7,6 +7,8 @@ package sources_test
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/singularityware/singularity/src/pkg/build/sources"
@@ -79,11 +81,15 @@ func TestShubParser(t *testing.T) {
 		`//username/container@00000000000000000000000000000000`,
 		`//registry/username/container`,
 		`//registry/with/levels/username/container`,
+		`//registry.example.com/api/container/username/container`,
 		`//registry/user-name/container-with-dash`,
 		`//registry/username/container.with.period`,
 		`//username/container:tag-with-dash`,
 		`//username/container:tag_wtih_underscore`,
 		`//username/container:tag.with.period`,
+		`//username/container@sha256:0000000000000000000000000000000000000000000000000000000000000000`,
+		`//username/container:tag@0000000000000000000000000000000000000000000000000000000000000000`,
+		`//username/container@sha512:00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000`,
 	}
 
 	invalidShubURIs := []string{
@@ -99,6 +105,14 @@ func TestShubParser(t *testing.T) {
 		`//username-/container:`,
 		`//-registry/username/container:`,
 		`//registry-/username/container:`,
+		`///username/container`,
+		`//username//container`,
+		`//registry//username/container`,
+		`//registry/with//levels/username/container`,
+		`//../username/container`,
+		`//username/container@sha1:0000000000000000000000000000000000000000`,
+		`//username/container@sha256:00000000000000000000000000000000`,
+		`//username/container@md5`,
 	}
 
 	for _, uri := range validShubURIs {
@@ -117,3 +131,451 @@ func TestShubParser(t *testing.T) {
 		}
 	}
 }
+
+// TestNewShubURI checks that a ShubURI built from components matches its parsed form
+func TestNewShubURI(t *testing.T) {
+	tests := []struct {
+		name                                   string
+		registry, user, container, tag, digest string
+		expected                               string
+		valid                                  bool
+	}{
+		{"DefaultRegistry", "", "username", "container", "", "", "//username/container", true},
+		{"CustomRegistry", "registry/with/levels", "username", "container", "tag", "", "//registry/with/levels/username/container:tag", true},
+		{"WithSeparators", "registry/", "username/", "container", ":tag", "@00000000000000000000000000000000", "//registry/username/container:tag@00000000000000000000000000000000", true},
+		{"MissingUser", "", "", "container", "", "", "", false},
+		{"InvalidDigest", "", "username", "container", "", "abc", "", false},
+		{"InvalidUser", "", "user.name", "container", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri, err := sources.NewShubURI(tt.registry, tt.user, tt.container, tt.tag, tt.digest)
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("failed to catch invalid components for %s", tt.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create URI: %v", err)
+			}
+
+			parsed, err := sources.ShubParseReference(tt.expected)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", tt.expected, err)
+			}
+			if uri.String() != parsed.String() {
+				t.Fatalf("unexpected URI %s, expected %s", uri.String(), parsed.String())
+			}
+		})
+	}
+}
+
+// TestShubURICanonical checks that equivalent references share a canonical form
+func TestShubURICanonical(t *testing.T) {
+	tests := []struct {
+		uri       string
+		canonical string
+	}{
+		{"//username/container", "singularity-hub.org/api/container/username/container:latest"},
+		{"//username/container:latest", "singularity-hub.org/api/container/username/container:latest"},
+		{"//username/container:tag@00000000000000000000000000000000", "singularity-hub.org/api/container/username/container:tag@00000000000000000000000000000000"},
+		{"//Registry.Example.COM/username/container", "registry.example.com/username/container:latest"},
+		{"//singularity-hub.org/api/container/username/container", "singularity-hub.org/api/container/username/container:latest"},
+		{"//www.singularity-hub.org/api/container/username/container:tag", "singularity-hub.org/api/container/username/container:tag"},
+	}
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReference(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+		if c := uri.Canonical(); c != tt.canonical {
+			t.Fatalf("unexpected canonical form %s for %s, expected %s", c, tt.uri, tt.canonical)
+		}
+	}
+}
+
+// TestShubParseFullyQualifiedDefault checks that the default registry written
+// explicitly is parsed as the default registry
+func TestShubParseFullyQualifiedDefault(t *testing.T) {
+	expected, err := sources.NewShubURI("", "username", "container", "tag", "")
+	if err != nil {
+		t.Fatalf("failed to create URI: %v", err)
+	}
+
+	for _, ref := range []string{
+		"//singularity-hub.org/api/container/username/container:tag",
+		"//www.singularity-hub.org/api/container/username/container:tag",
+		"//Singularity-Hub.org/api/container/username/container:tag",
+	} {
+		uri, err := sources.ShubParseReference(ref)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", ref, err)
+		}
+		if uri != expected {
+			t.Fatalf("%s isn't parsed as the default registry: %s", ref, uri.String())
+		}
+	}
+
+	uri, err := sources.NewShubURI("www.singularity-hub.org/api/container", "username", "container", "tag", "")
+	if err != nil {
+		t.Fatalf("failed to create URI: %v", err)
+	}
+	if uri != expected {
+		t.Fatalf("fully qualified registry isn't the default registry: %s", uri.String())
+	}
+}
+
+// TestShubParserHint checks that invalid references are reported with the likely problem
+func TestShubParserHint(t *testing.T) {
+	tests := []struct {
+		uri  string
+		hint string
+	}{
+		{"//container", "missing user"},
+		{"//username/", "missing container name"},
+		{"//username/container:", "empty tag"},
+		{"//username/container@abc", "digest must be an md5 sum"},
+	}
+
+	for _, tt := range tests {
+		_, err := sources.ShubParseReference(tt.uri)
+		if err == nil {
+			t.Fatalf("failed to catch invalid URI %s", tt.uri)
+		}
+		if !strings.Contains(err.Error(), tt.hint) {
+			t.Fatalf("error %q for %s doesn't mention %q", err, tt.uri, tt.hint)
+		}
+	}
+}
+
+// TestShubParseDefaultUser checks that the default user applies to references without user
+func TestShubParseDefaultUser(t *testing.T) {
+	os.Setenv("SINGULARITY_SHUB_DEFAULT_USER", "organization")
+	defer os.Unsetenv("SINGULARITY_SHUB_DEFAULT_USER")
+
+	expected, err := sources.NewShubURI("", "organization", "container", "tag", "")
+	if err != nil {
+		t.Fatalf("failed to create URI: %v", err)
+	}
+
+	uri, err := sources.ShubParseReference("//container:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference without user: %v", err)
+	}
+	if uri != expected {
+		t.Fatalf("unexpected URI %s, expected %s", uri.String(), expected.String())
+	}
+
+	uri, err = sources.ShubParseReference("//username/container:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference with user: %v", err)
+	}
+	if uri == expected {
+		t.Fatalf("default user overrode explicit user")
+	}
+
+	uri, err = sources.ShubParseReference("//container:feature/foo")
+	if err != nil {
+		t.Fatalf("failed to parse reference without user: %v", err)
+	}
+	if uri.String() != "singularity-hub.org/api/container/organization/container:feature/foo" {
+		t.Fatalf("default user wasn't applied to reference with slash tag: %s", uri.String())
+	}
+}
+
+// TestShubURIEqual checks the comparison of references across formatting differences
+func TestShubURIEqual(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		compare int
+	}{
+		{"//username/container", "//username/container:latest", 0},
+		{"//singularity-hub.org/api/container/username/container", "//username/container", 0},
+		{"//Registry.Example.COM/username/container:tag", "//registry.example.com/username/container:tag", 0},
+		{"//username/container:a", "//username/container:b", -1},
+		{"//username/container:tag@00000000000000000000000000000000", "//username/container:tag", 1},
+	}
+
+	for _, tt := range tests {
+		a, err := sources.ShubParseReference(tt.a)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.a, err)
+		}
+		b, err := sources.ShubParseReference(tt.b)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.b, err)
+		}
+
+		if c := sources.CompareShubURI(a, b); c != tt.compare {
+			t.Fatalf("unexpected comparison %d of %s and %s, expected %d", c, tt.a, tt.b, tt.compare)
+		}
+		if a.Equal(b) != (tt.compare == 0) {
+			t.Fatalf("unexpected equality of %s and %s", tt.a, tt.b)
+		}
+	}
+}
+
+// TestValidateReference checks the validation of references as written by users
+func TestValidateReference(t *testing.T) {
+	expected, err := sources.NewShubURI("", "username", "container", "tag", "")
+	if err != nil {
+		t.Fatalf("failed to create URI: %v", err)
+	}
+
+	for _, ref := range []string{
+		"username/container:tag",
+		"//username/container:tag",
+		"shub://username/container:tag",
+		"shub:username/container:tag",
+		"  shub://username/container:tag\n",
+	} {
+		uri, err := sources.ValidateReference(ref)
+		if err != nil {
+			t.Fatalf("failed to validate %q: %v", ref, err)
+		}
+		if uri != expected {
+			t.Fatalf("unexpected URI %s for %q, expected %s", uri.String(), ref, expected.String())
+		}
+	}
+
+	for _, ref := range []string{
+		"",
+		"docker://username/container:tag",
+		"shub://username/",
+		"username/container:tag extra",
+	} {
+		_, err := sources.ValidateReference(ref)
+		if _, ok := err.(*sources.ReferenceError); !ok {
+			t.Fatalf("unexpected error %v for invalid reference %q", err, ref)
+		}
+	}
+}
+
+// TestShubParseFileSelector checks references selecting a file of the container
+func TestShubParseFileSelector(t *testing.T) {
+	tests := []struct {
+		uri       string
+		canonical string
+	}{
+		{"//username/container:tag#image.sif", "singularity-hub.org/api/container/username/container:tag#image.sif"},
+		{"//username/container:tag#path/to/image.sif", "singularity-hub.org/api/container/username/container:tag#path/to/image.sif"},
+		{"//registry/username/container:tag@00000000000000000000000000000000#image.simg", "registry/username/container:tag@00000000000000000000000000000000#image.simg"},
+		{"//username/container#image.sif", "singularity-hub.org/api/container/username/container:latest#image.sif"},
+		{"//username/container:feature/foo#image.sif", "singularity-hub.org/api/container/username/container:feature/foo#image.sif"},
+		{"//username/container:tag", "singularity-hub.org/api/container/username/container:tag"},
+	}
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReference(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+		if c := uri.Canonical(); c != tt.canonical {
+			t.Fatalf("unexpected canonical form %s for %s, expected %s", c, tt.uri, tt.canonical)
+		}
+		parsed, err := sources.ShubParseReference("//" + uri.String())
+		if err != nil || parsed != uri {
+			t.Fatalf("%s doesn't round-trip through its string form %s: %v", tt.uri, uri.String(), err)
+		}
+	}
+
+	for _, uri := range []string{
+		"//username/container:tag#",
+		"//username/container:tag#image.sif/",
+		"//username/container:tag#path//image.sif",
+		"//username/container:tag#../image.sif",
+		"//username/container:tag#path/./image.sif",
+		"//username/container:tag#image sif",
+	} {
+		if _, err := sources.ShubParseReference(uri); err == nil {
+			t.Fatalf("failed to catch invalid file selector %s", uri)
+		}
+	}
+
+	// without tag, further path segments are registry levels
+	uri, err := sources.ShubParseReference("//registry/username/container")
+	if err != nil {
+		t.Fatalf("failed to parse reference without tag: %v", err)
+	}
+	if uri.Canonical() != "registry/username/container:latest" {
+		t.Fatalf("reference without tag parsed with a file: %s", uri.Canonical())
+	}
+}
+
+// TestShubParseURLEncoded checks references with URL-encoded separators
+func TestShubParseURLEncoded(t *testing.T) {
+	tests := []struct {
+		uri       string
+		canonical string
+	}{
+		{"//username/container%3Atag", "singularity-hub.org/api/container/username/container:tag"},
+		{"//username/container%40" + "00000000000000000000000000000000", "singularity-hub.org/api/container/username/container:latest@00000000000000000000000000000000"},
+		{"%2F%2Fregistry%2Fusername%2Fcontainer%3Afeature%2Ffoo%40sha256%3A" + strings.Repeat("0", 64), "registry/username/container:feature/foo@sha256:" + strings.Repeat("0", 64)},
+		{"//username/container:tag", "singularity-hub.org/api/container/username/container:tag"},
+	}
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReferenceURLEncoded(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+		if c := uri.Canonical(); c != tt.canonical {
+			t.Fatalf("unexpected canonical form %s for %s, expected %s", c, tt.uri, tt.canonical)
+		}
+	}
+
+	for _, uri := range []string{"//username/container%3", "//username/container%zztag", "//username/container%20tag"} {
+		if _, err := sources.ShubParseReferenceURLEncoded(uri); err == nil {
+			t.Fatalf("failed to catch invalid encoded reference %s", uri)
+		}
+	}
+	if _, err := sources.ShubParseReference("//username/container%40" + "00000000000000000000000000000000"); err == nil {
+		t.Fatalf("encoded reference parsed without decoding")
+	}
+}
+
+// TestShubParseSlashTag checks tags containing slashes, as branch names do
+func TestShubParseSlashTag(t *testing.T) {
+	tests := []struct {
+		uri       string
+		canonical string
+	}{
+		{"//username/container:feature/foo", "singularity-hub.org/api/container/username/container:feature/foo"},
+		{"//username/container:feature/foo/bar", "singularity-hub.org/api/container/username/container:feature/foo/bar"},
+		{"//registry/username/container:feature/foo", "registry/username/container:feature/foo"},
+		{"//registry/path/username/container:feature/foo@00000000000000000000000000000000", "registry/path/username/container:feature/foo@00000000000000000000000000000000"},
+	}
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReference(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+		if c := uri.Canonical(); c != tt.canonical {
+			t.Fatalf("unexpected canonical form %s for %s, expected %s", c, tt.uri, tt.canonical)
+		}
+		if s := uri.String(); s != tt.canonical {
+			t.Fatalf("unexpected string form %s for %s, expected %s", s, tt.uri, tt.canonical)
+		}
+		parsed, err := sources.ShubParseReference("//" + uri.String())
+		if err != nil || parsed != uri {
+			t.Fatalf("%s doesn't round-trip through its string form %s: %v", tt.uri, uri.String(), err)
+		}
+	}
+
+	for _, uri := range []string{
+		"//username/container:feature/",
+		"//username/container:/foo",
+		"//username/container:feature//foo",
+		"//username/container:feature/../foo",
+		"//username/container:feature/./foo",
+	} {
+		if _, err := sources.ShubParseReference(uri); err == nil {
+			t.Fatalf("failed to catch invalid tag %s", uri)
+		}
+	}
+}
+
+// TestShubParseRoundTrip checks that parsed references parse again from their
+// String and Canonical forms, as the Fuzz target does, on its seeds and the
+// inputs it found crashes with
+func TestShubParseRoundTrip(t *testing.T) {
+	valid := []string{
+		"//username/container",
+		"//username/container:tag",
+		"//Registry.Example.ORG/path/username/container:feature/foo@sha256:" + strings.Repeat("0", 64),
+		"//www.singularity-hub.org/username/container@00000000000000000000000000000000",
+		"//username/container:tag#dir/file.simg",
+	}
+	for _, src := range valid {
+		uri, err := sources.ShubParseReference(src)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", src, err)
+		}
+		for _, form := range []string{uri.String(), uri.Canonical()} {
+			again, err := sources.ShubParseReference("//" + form)
+			if err != nil {
+				t.Fatalf("failed to parse %s, parsed from %s: %v", form, src, err)
+			}
+			if !again.Equal(uri) {
+				t.Fatalf("%s parsed from %s parses to %s", form, src, again.Canonical())
+			}
+		}
+	}
+
+	for _, src := range []string{"", "#file", "//", "//#file"} {
+		if _, err := sources.ShubParseReference(src); err == nil {
+			t.Fatalf("failed to catch invalid reference %q", src)
+		}
+	}
+}
+
+// TestShubExpandEnv checks the expansion of environment variables in the
+// reference of definitions
+func TestShubExpandEnv(t *testing.T) {
+	os.Setenv("SHUB_TEST_USER", "username")
+	defer os.Unsetenv("SHUB_TEST_USER")
+	os.Setenv("SHUB_TEST_TAG", "tag")
+	defer os.Unsetenv("SHUB_TEST_TAG")
+
+	def := types.Definition{Header: map[string]string{"from": "shub://$SHUB_TEST_USER/container:${SHUB_TEST_TAG}"}}
+
+	cp := &sources.ShubConveyorPacker{ExpandEnv: true}
+	requests, err := cp.DryRunRequests(def)
+	if err != nil {
+		t.Fatalf("failed to expand reference: %v", err)
+	}
+	if expected := "https://www.singularity-hub.org/api/container/username/container:tag"; len(requests) != 1 || requests[0].URL != expected {
+		t.Fatalf("unexpected requests %v, expected GET %s", requests, expected)
+	}
+
+	def.Header["from"] = "shub://$SHUB_TEST_USER/container:$SHUB_TEST_UNDEFINED"
+	if _, err := cp.DryRunRequests(def); err == nil || !strings.Contains(err.Error(), "SHUB_TEST_UNDEFINED") {
+		t.Fatalf("failed to report undefined variable: %v", err)
+	}
+
+	cp.ExpandEnv = false
+	if _, err := cp.DryRunRequests(def); err == nil {
+		t.Fatalf("reference expanded without ExpandEnv")
+	}
+}
+
+// TestShubReservedNames checks that user and container names reserved by the
+// registry API are only rejected on request
+func TestShubReservedNames(t *testing.T) {
+	tests := []struct {
+		uri      string
+		reserved bool
+	}{
+		{"//api/container", true},
+		{"//Search/container:tag", true},
+		{"//username/container", true},
+		{"//username/API", true},
+		{"//username/image", false},
+		{"//registry.example.org/api/container/username/image", false},
+		{"//registry.example.org/search/container", false},
+	}
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReference(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+		if err := uri.ValidateReserved(); (err != nil) != tt.reserved {
+			t.Errorf("unexpected validation of reserved names of %s: %v", tt.uri, err)
+		}
+	}
+
+	def := types.Definition{Header: map[string]string{"from": "shub://search/image"}}
+	cp := &sources.ShubConveyorPacker{}
+	if _, err := cp.DryRunRequests(def); err != nil {
+		t.Fatalf("reserved user rejected without RejectReservedNames: %v", err)
+	}
+	cp.RejectReservedNames = true
+	if _, err := cp.DryRunRequests(def); err == nil {
+		t.Fatalf("failed to reject reserved user with RejectReservedNames")
+	}
+}
@@ -36,6 +36,22 @@ func (p *SIFPacker) Pack() (*types.Bundle, error) {
 	return p.b, nil
 }
 
+// sifArch returns the Go architecture recorded in the global header of the
+// SIF at path, empty when the image doesn't record a known architecture
+func sifArch(path string) (string, error) {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return "", err
+	}
+	defer fimg.UnloadContainer()
+
+	arch := sif.GetGoArch(string(fimg.Header.Arch[:]))
+	if arch == "unknown" {
+		return "", nil
+	}
+	return arch, nil
+}
+
 // First pass just assumes a single system partition, later passes will handle more complex sif files
 // unpackSIF parses throught the sif file and places each component in the sandbox
 func (p *SIFPacker) unpackSIF(b *types.Bundle, rootfs string) (err error) {
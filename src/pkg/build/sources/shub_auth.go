@@ -0,0 +1,228 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+	"github.com/singularityware/singularity/src/pkg/util/user"
+)
+
+// Environment variables holding Singularity Hub credentials
+const (
+	shubUsernameEnv = "SINGULARITY_SHUB_USERNAME"
+	shubPasswordEnv = "SINGULARITY_SHUB_PASSWORD"
+)
+
+// shubCredentials holds a username and password for basic authentication
+type shubCredentials struct {
+	username string
+	password string
+}
+
+// credentials returns the credentials to use for host. Explicit fields take
+// precedence over the registry profile and the environment, which take
+// precedence over the credential store and the netrc file
+func (cp *ShubConveyorPacker) credentials(host string) (creds shubCredentials, ok bool) {
+	if cp.Username != "" {
+		return shubCredentials{cp.Username, cp.Password}, true
+	}
+	if p, ok := cp.profile(host); ok && p.Username != "" {
+		return shubCredentials{p.Username, p.Password}, true
+	}
+
+	if username := os.Getenv(shubUsernameEnv); username != "" {
+		return shubCredentials{username, os.Getenv(shubPasswordEnv)}, true
+	}
+
+	hosts := []string{host}
+	if strings.HasPrefix(host, "www.") {
+		hosts = append(hosts, strings.TrimPrefix(host, "www."))
+	}
+
+	for _, h := range hosts {
+		if cp.CredentialStore != "" {
+			creds, ok, err := credentialStoreLookup(cp.CredentialStore, h)
+			if err != nil {
+				sylog.Warningf("Unable to read credential store %s: %v", cp.CredentialStore, err)
+			} else if ok {
+				return creds, true
+			}
+		}
+
+		creds, ok, err := netrcLookup(netrcPath(), h)
+		if err != nil {
+			sylog.Warningf("Unable to read netrc file: %v", err)
+		} else if ok {
+			return creds, true
+		}
+	}
+
+	return creds, false
+}
+
+// setAuth adds basic authentication to req when credentials are known for
+// the registry. Requests to other hosts, such as mirrors or the storage
+// serving the image, never receive the registry credentials, only those of
+// the RegistryProfile of their own host
+func (cp *ShubConveyorPacker) setAuth(req *http.Request) {
+	host := req.URL.Hostname()
+	if host != cp.registryHost() {
+		if p, ok := cp.profile(host); ok && p.Username != "" {
+			req.SetBasicAuth(p.Username, p.Password)
+		}
+		return
+	}
+
+	if cp.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cp.bearerToken)
+		return
+	}
+
+	if creds, ok := cp.credentials(host); ok {
+		req.SetBasicAuth(creds.username, creds.password)
+	}
+}
+
+// registryHost returns the host serving the registry API
+func (cp *ShubConveyorPacker) registryHost() string {
+	if cp.authHost != "" {
+		return cp.authHost
+	}
+
+	u := apiURL(cp.srcURI)
+	return u.Hostname()
+}
+
+// netrcPath returns the location of the netrc file, honoring $NETRC
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	pw, err := user.GetPwUID(uint32(os.Getuid()))
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(pw.Dir, ".netrc")
+}
+
+// netrcLookup returns the credentials of the netrc machine entry for host,
+// or of the default entry. A missing netrc file isn't an error
+func netrcLookup(path, host string) (creds shubCredentials, ok bool, err error) {
+	if path == "" {
+		return creds, false, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return creds, false, nil
+	} else if err != nil {
+		return creds, false, err
+	}
+
+	var current *shubCredentials
+	var found, fallback *shubCredentials
+
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			current = nil
+			if i+1 < len(fields) {
+				i++
+				if fields[i] == host && found == nil {
+					found = &shubCredentials{}
+					current = found
+				}
+			}
+		case "default":
+			current = nil
+			if fallback == nil {
+				fallback = &shubCredentials{}
+				current = fallback
+			}
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				break
+			}
+			i++
+			if current == nil {
+				continue
+			}
+			if fields[i-1] == "login" {
+				current.username = fields[i]
+			} else if fields[i-1] == "password" {
+				current.password = fields[i]
+			}
+		case "macdef":
+			// macro definitions run until the next blank line and can't
+			// hold credentials, stop parsing rather than misreading them
+			i = len(fields)
+		}
+	}
+
+	if found != nil {
+		return *found, true, nil
+	}
+	if fallback != nil {
+		return *fallback, true, nil
+	}
+	return creds, false, nil
+}
+
+// credentialStoreLookup returns the credentials for host from a JSON
+// credential store in the format of the Docker client configuration:
+//
+//	{"auths": {"host": {"auth": "base64(username:password)"}}}
+func credentialStoreLookup(path, host string) (creds shubCredentials, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return creds, false, err
+	}
+
+	var store struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return creds, false, err
+	}
+
+	entry, ok := store.Auths[host]
+	if !ok {
+		entry, ok = store.Auths["https://"+host]
+	}
+	if !ok {
+		return creds, false, nil
+	}
+
+	if entry.Auth == "" {
+		return shubCredentials{entry.Username, entry.Password}, true, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return creds, false, fmt.Errorf("invalid auth for %s: %v", host, err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return creds, false, fmt.Errorf("invalid auth for %s", host)
+	}
+
+	return shubCredentials{parts[0], parts[1]}, true, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetrcLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-netrc-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name  string
+		netrc string
+		host  string
+		ok    bool
+		want  shubCredentials
+	}{
+		{"Machine", "machine singularity-hub.org login user password secret", "singularity-hub.org", true, shubCredentials{"user", "secret"}},
+		{"MultiLine", "machine other.org\n\tlogin other\n\tpassword pass\nmachine singularity-hub.org\n\tlogin user\n\taccount team\n\tpassword secret\n", "singularity-hub.org", true, shubCredentials{"user", "secret"}},
+		{"FirstMachine", "machine singularity-hub.org login first password one\nmachine singularity-hub.org login second password two", "singularity-hub.org", true, shubCredentials{"first", "one"}},
+		{"Default", "machine other.org login other password pass\ndefault login anonymous password guest", "singularity-hub.org", true, shubCredentials{"anonymous", "guest"}},
+		{"MachineOverDefault", "default login anonymous password guest\nmachine singularity-hub.org login user password secret", "singularity-hub.org", true, shubCredentials{"user", "secret"}},
+		{"NonMatchingHost", "machine other.org login other password pass", "singularity-hub.org", false, shubCredentials{}},
+		{"HostPrefix", "machine singularity-hub.org.example.org login other password pass", "singularity-hub.org", false, shubCredentials{}},
+		{"MissingPassword", "machine singularity-hub.org login user", "singularity-hub.org", true, shubCredentials{"user", ""}},
+		{"TruncatedPassword", "machine singularity-hub.org login user password", "singularity-hub.org", true, shubCredentials{"user", ""}},
+		{"Macro", "macdef init\nmachine singularity-hub.org login user password secret", "singularity-hub.org", false, shubCredentials{}},
+		{"Empty", "", "singularity-hub.org", false, shubCredentials{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, []byte(tt.netrc), 0600); err != nil {
+				t.Fatalf("unable to write netrc file: %v", err)
+			}
+
+			creds, ok, err := netrcLookup(path, tt.host)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, expected %v", ok, tt.ok)
+			}
+			if creds != tt.want {
+				t.Fatalf("got credentials %+v, expected %+v", creds, tt.want)
+			}
+		})
+	}
+
+	for _, path := range []string{"", filepath.Join(dir, "missing")} {
+		if _, ok, err := netrcLookup(path, "singularity-hub.org"); ok || err != nil {
+			t.Fatalf("unexpected result for missing netrc file %q: %v %v", path, ok, err)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// Cache describes a backend storing downloaded images by key
+type Cache interface {
+	// Get returns a reader for the entry stored under key, and whether it exists
+	Get(key string) (io.ReadCloser, bool)
+	// Put stores the content read from r under key
+	Put(key string, r io.Reader) error
+}
+
+// CacheStats holds the number of lookups served by a cache
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// HitRate returns the fraction of lookups that were served from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// FileCache is a Cache storing each entry as a file below a directory. A
+// single FileCache may be shared by several packers to collect statistics
+// across a build session
+type FileCache struct {
+	// Mode is the permission of the cached files before applying the
+	// umask, 0 keeps the restrictive default of 0600
+	Mode os.FileMode
+	// Compress stores new entries gzip compressed to save disk space
+	Compress bool
+
+	dir    string
+	hits   int64
+	misses int64
+}
+
+// NewFileCache creates a FileCache rooted at dir
+func NewFileCache(dir string) *FileCache {
+	return &FileCache{dir: dir}
+}
+
+// ShubCacheKey returns the key under which the image for uri is cached.
+// The container, tag and file become path components of the key, so values that
+// could traverse out of their directory are rejected. Slashes of tags are
+// escaped, so a tag never names the directory of another
+func ShubCacheKey(uri ShubURI) (string, error) {
+	tag := strings.Replace(strings.TrimPrefix(uri.tag, `:`), `/`, "%2F", -1)
+	if tag == "" {
+		tag = "latest"
+	}
+
+	for _, c := range []struct{ name, value string }{{"container", uri.container}, {"tag", tag}} {
+		if strings.Contains(c.value, "..") || strings.ContainsAny(c.value, `/\`) {
+			return "", fmt.Errorf("%s %q can't be used in a cache path", c.name, c.value)
+		}
+	}
+
+	// files of containers holding several images are cached apart, below a
+	// directory whose name can't be a tag, as tags can't hold a `#`
+	if uri.file != "" {
+		if strings.Contains(uri.file, "..") || strings.Contains(uri.file, `\`) {
+			return "", fmt.Errorf("file %q can't be used in a cache path", uri.file)
+		}
+		tag += "#files/" + strings.TrimPrefix(uri.file, `#`)
+	}
+
+	return "shub/" + uri.registry + uri.user + uri.container + "/" + tag, nil
+}
+
+// compressedSuffix marks cache entries stored gzip compressed
+const compressedSuffix = ".gz"
+
+// Path returns the file holding the entry for key, making sure it
+// stays within the cache directory
+func (c *FileCache) Path(key string) (string, error) {
+	path, err := c.basePath(key)
+	if err != nil {
+		return "", err
+	}
+
+	if c.Compress {
+		path += compressedSuffix
+	}
+	return path, nil
+}
+
+// basePath returns the file holding the uncompressed entry for key
+func (c *FileCache) basePath(key string) (string, error) {
+	path := filepath.Join(c.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(c.dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("cache key %q is outside of cache directory %s", key, c.dir)
+	}
+	return path, nil
+}
+
+// Get opens the file stored under key. Compressed entries are decompressed
+// while reading, whatever the current Compress setting. Opened entries count
+// as hits, until rejected by the caller with Reject
+func (c *FileCache) Get(key string) (io.ReadCloser, bool) {
+	path, err := c.basePath(key)
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	if f, err := os.Open(path); err == nil {
+		atomic.AddInt64(&c.hits, 1)
+		return f, true
+	}
+
+	f, err := os.Open(path + compressedSuffix)
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		sylog.Warningf("Ignoring corrupted cache entry %s: %v", f.Name(), err)
+		f.Close()
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	return &gzipFile{Reader: zr, f: f}, true
+}
+
+// gzipFile reads a gzip compressed file, closing it with the reader
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Reject counts the last entry returned by Get for key as a miss instead of
+// a hit, when the caller can't use it, e.g. as it doesn't match the version
+// or digest expected
+func (c *FileCache) Reject(key string) {
+	atomic.AddInt64(&c.hits, -1)
+	atomic.AddInt64(&c.misses, 1)
+}
+
+// Stats returns the hit and miss counters of the cache
+func (c *FileCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// LogStats reports the cache statistics, typically at the end of a build
+func (c *FileCache) LogStats() {
+	stats := c.Stats()
+	sylog.Infof("Image cache %s: %d hits, %d misses (%.0f%% hit rate)", c.dir, stats.Hits, stats.Misses, 100*stats.HitRate())
+}
+
+// Put writes r to a temporary file next to the entry and renames it in
+// place, so a partially written entry is never visible to Get
+func (c *FileCache) Put(key string, r io.Reader) error {
+	path, err := c.Path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("could not create cache entry: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if c.Compress {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+
+	// the digest is computed on the uncompressed content while writing it
+	h := md5.New()
+	if _, err := io.Copy(w, io.TeeReader(r, h)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write cache entry: %v", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not write cache entry: %v", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write cache entry: %v", err)
+	}
+
+	if c.Mode != 0 {
+		if err := chmodWithUmask(tmp.Name(), c.Mode); err != nil {
+			return fmt.Errorf("could not set cache entry permissions: %v", err)
+		}
+	}
+
+	// the digest is stored first so an entry never exists without it
+	if err := c.putDigest(key, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// drop the entry stored with the other compression setting, as Get
+	// prefers uncompressed entries
+	other := strings.TrimSuffix(path, compressedSuffix)
+	if !c.Compress {
+		other = path + compressedSuffix
+	}
+	if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+		sylog.Warningf("Unable to remove stale cache entry %s: %v", other, err)
+	}
+
+	return nil
+}
+
+// Remove deletes the entry stored under key, compressed or not, along with
+// its digest. Removing a missing entry isn't an error
+func (c *FileCache) Remove(key string) error {
+	path, err := c.basePath(key)
+	if err != nil {
+		return err
+	}
+	digest, err := c.digestPath(key)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{path, path + compressedSuffix, digest} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove cache entry: %v", err)
+		}
+	}
+	return nil
+}
+
+// Purge removes the image cached for ref, with its digest and recorded
+// version, so the next pull downloads it again. Purging a reference that
+// isn't cached isn't an error
+func (c *FileCache) Purge(ref ShubURI) error {
+	key, err := ShubCacheKey(ref)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range []string{key, versionKey(key)} {
+		if err := c.Remove(k); err != nil {
+			return err
+		}
+	}
+	sylog.Debugf("Purged cache entry %s", key)
+	return nil
+}
+
+// CacheEntry describes an entry stored in a FileCache
+type CacheEntry struct {
+	// Key is the key the entry is stored under
+	Key string
+	// Size is the size of the entry on disk, compressed or not
+	Size int64
+	// Compressed is true when the entry is stored gzip compressed
+	Compressed bool
+	// ModTime is the time the entry was stored
+	ModTime time.Time
+	// AccessTime is the time the entry was last read, as far as the
+	// filesystem keeps track of it
+	AccessTime time.Time
+}
+
+// List returns every image of the cache sorted by key, e.g. to prune the
+// least recently used entries. The digests and versions recorded alongside
+// images aren't listed
+func (c *FileCache) List() ([]CacheEntry, error) {
+	sidecars := map[string]bool{
+		filepath.Join(c.dir, "md5"):            true,
+		filepath.Join(c.dir, versionKeyPrefix): true,
+	}
+
+	var entries []CacheEntry
+	err := filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == c.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if sidecars[path] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+
+		entry := CacheEntry{
+			Key:        filepath.ToSlash(strings.TrimSuffix(rel, compressedSuffix)),
+			Size:       fi.Size(),
+			Compressed: strings.HasSuffix(rel, compressedSuffix),
+			ModTime:    fi.ModTime(),
+			AccessTime: fi.ModTime(),
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			entry.AccessTime = time.Unix(st.Atim.Sec, st.Atim.Nsec)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list cache entries: %v", err)
+	}
+
+	return entries, nil
+}
+
+// digestPath returns the sidecar file holding the digest of the entry for key
+func (c *FileCache) digestPath(key string) (string, error) {
+	return c.basePath("md5/" + key)
+}
+
+// putDigest atomically stores digest in the sidecar of the entry for key
+func (c *FileCache) putDigest(key, digest string) error {
+	path, err := c.digestPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("could not create cache digest: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(digest); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write cache digest: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write cache digest: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Digest returns the md5 digest of the uncompressed content stored under key,
+// as computed when it was written, and whether it is known
+func (c *FileCache) Digest(key string) (string, bool) {
+	path, err := c.digestPath(key)
+	if err != nil {
+		return "", false
+	}
+
+	digest, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return string(digest), true
+}
+
+// processUmask is the umask of the process, read once at startup as
+// reading it otherwise requires changing it process wide while files may be
+// created concurrently
+var processUmask = readUmask()
+
+// readUmask returns the umask of the process from /proc when available,
+// which doesn't change it
+func readUmask() os.FileMode {
+	if status, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if !strings.HasPrefix(line, "Umask:") {
+				continue
+			}
+			if mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "Umask:")), 8, 32); err == nil {
+				return os.FileMode(mask)
+			}
+		}
+	}
+
+	oldmask := syscall.Umask(0)
+	syscall.Umask(oldmask)
+	return os.FileMode(oldmask)
+}
+
+// chmodWithUmask changes the permissions of path to mode, restricted by the
+// umask of the process like a newly created file would be
+func chmodWithUmask(path string, mode os.FileMode) error {
+	return os.Chmod(path, mode&^processUmask)
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/singularityware/singularity/src/pkg/build/sources"
+)
+
+// TestFileCache checks that entries put into a FileCache can be read back
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := sources.NewFileCache(dir)
+
+	if _, ok := c.Get("shub/username/container/latest"); ok {
+		t.Fatalf("unexpected entry in empty cache")
+	}
+
+	if err := c.Put("shub/username/container/latest", strings.NewReader("image")); err != nil {
+		t.Fatalf("failed to put cache entry: %v", err)
+	}
+
+	r, ok := c.Get("shub/username/container/latest")
+	if !ok {
+		t.Fatalf("failed to get cache entry")
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read cache entry: %v", err)
+	}
+	if string(content) != "image" {
+		t.Fatalf("unexpected cache content %q", content)
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatalf("failed to list cache entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "shub/username/container/latest" || entries[0].Size != 5 || entries[0].Compressed {
+		t.Fatalf("unexpected cache entries %+v", entries)
+	}
+
+	if err := c.Put("shub-version/username/container/latest", strings.NewReader("v1")); err != nil {
+		t.Fatalf("failed to put version entry: %v", err)
+	}
+	if entries, err = c.List(); err != nil {
+		t.Fatalf("failed to list cache entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "shub/username/container/latest" {
+		t.Fatalf("version entry listed with the images: %+v", entries)
+	}
+
+	if err := c.Put("../outside", strings.NewReader("image")); err == nil {
+		t.Fatalf("failed to reject key outside of cache directory")
+	}
+
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected cache statistics %+v", stats)
+	}
+
+	if err := c.Remove("shub/username/container/latest"); err != nil {
+		t.Fatalf("failed to remove cache entry: %v", err)
+	}
+	if _, ok := c.Get("shub/username/container/latest"); ok {
+		t.Fatalf("unexpected entry after removal")
+	}
+	if _, ok := c.Digest("shub/username/container/latest"); ok {
+		t.Fatalf("unexpected digest after removal")
+	}
+}
+
+// TestFileCacheCompress checks that compressed entries are read back decompressed
+func TestFileCacheCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := sources.NewFileCache(dir)
+	c.Compress = true
+
+	if err := c.Put("shub/username/container/latest", strings.NewReader("image")); err != nil {
+		t.Fatalf("failed to put cache entry: %v", err)
+	}
+
+	path, err := c.Path("shub/username/container/latest")
+	if err != nil {
+		t.Fatalf("failed to get cache path: %v", err)
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		t.Fatalf("compressed entry %s isn't marked as compressed", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("compressed entry not found: %v", err)
+	}
+
+	r, ok := c.Get("shub/username/container/latest")
+	if !ok {
+		t.Fatalf("failed to get cache entry")
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read cache entry: %v", err)
+	}
+	if string(content) != "image" {
+		t.Fatalf("unexpected cache content %q", content)
+	}
+
+	if digest, ok := c.Digest("shub/username/container/latest"); !ok || digest != "78805a221a988e79ef3f42d7c5bfd418" {
+		t.Fatalf("unexpected digest %q of uncompressed content", digest)
+	}
+}
+
+// TestShubCacheKeyFiles checks that the files of a container are cached
+// apart from the images of its other tags
+func TestShubCacheKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := sources.NewFileCache(dir)
+	for _, src := range []string{"//username/container:tag#image.sif", "//username/container:tag.files", "//username/container:tag"} {
+		uri, err := sources.ShubParseReference(src)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", src, err)
+		}
+		key, err := sources.ShubCacheKey(uri)
+		if err != nil {
+			t.Fatalf("failed to get cache key for %s: %v", src, err)
+		}
+		if err := c.Put(key, strings.NewReader(src)); err != nil {
+			t.Fatalf("failed to cache %s: %v", src, err)
+		}
+
+		r, ok := c.Get(key)
+		if !ok {
+			t.Fatalf("failed to get cache entry of %s", src)
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(content) != src {
+			t.Fatalf("unexpected cache content %q for %s: %v", content, src, err)
+		}
+	}
+}
+
+// TestShubCacheKey checks that cache keys are derived from the reference
+func TestShubCacheKey(t *testing.T) {
+	tests := []struct {
+		uri string
+		key string
+	}{
+		{"//username/container", "shub/singularity-hub.org/api/container/username/container/latest"},
+		{"//username/container:tag", "shub/singularity-hub.org/api/container/username/container/tag"},
+		{"//registry/username/container:tag", "shub/registry/username/container/tag"},
+		{"//username/container:tag#path/image.sif", "shub/singularity-hub.org/api/container/username/container/tag#files/path/image.sif"},
+		{"//username/container:tag.files", "shub/singularity-hub.org/api/container/username/container/tag.files"},
+		{"//username/container:feature/foo", "shub/singularity-hub.org/api/container/username/container/feature%2Ffoo"},
+	}
+
+	for _, src := range []string{"//username/container:..", "//username/..:tag", "//username/container:a..b"} {
+		uri, err := sources.ShubParseReference(src)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", src, err)
+		}
+		if _, err := sources.ShubCacheKey(uri); err == nil {
+			t.Fatalf("failed to reject path traversal in %s", src)
+		}
+	}
+
+	c := sources.NewFileCache("/var/cache/shub")
+
+	for _, tt := range tests {
+		uri, err := sources.ShubParseReference(tt.uri)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tt.uri, err)
+		}
+
+		key, err := sources.ShubCacheKey(uri)
+		if err != nil {
+			t.Fatalf("failed to get cache key for %s: %v", tt.uri, err)
+		}
+		if key != tt.key {
+			t.Fatalf("unexpected cache key %s for %s, expected %s", key, tt.uri, tt.key)
+		}
+
+		path, err := c.Path(key)
+		if err != nil {
+			t.Fatalf("failed to get cache path for %s: %v", tt.uri, err)
+		}
+		if path != "/var/cache/shub/"+tt.key {
+			t.Fatalf("unexpected cache path %s for %s", path, tt.uri)
+		}
+	}
+}
+
+// TestFileCachePurge checks that purging a reference only removes its own entries
+func TestFileCachePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := sources.NewFileCache(dir)
+	uri, err := sources.ShubParseReference("//username/container:tag")
+	if err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	key, err := sources.ShubCacheKey(uri)
+	if err != nil {
+		t.Fatalf("unable to compute cache key: %v", err)
+	}
+	other := "shub/singularity-hub.org/api/container/username/container/other"
+	for _, k := range []string{key, other} {
+		if err := c.Put(k, strings.NewReader(k)); err != nil {
+			t.Fatalf("unable to put entry %s: %v", k, err)
+		}
+	}
+
+	cp := &sources.ShubConveyorPacker{Cache: c}
+	if err := cp.PurgeCache("shub://username/container:tag"); err != nil {
+		t.Fatalf("unable to purge %s: %v", uri.String(), err)
+	}
+	if _, ok := c.Get(key); ok {
+		t.Fatalf("purged entry is still cached")
+	}
+	if _, ok := c.Digest(key); ok {
+		t.Fatalf("digest of purged entry is still cached")
+	}
+	if r, ok := c.Get(other); !ok {
+		t.Fatalf("entry of another tag was purged")
+	} else {
+		r.Close()
+	}
+
+	if err := c.Purge(uri); err != nil {
+		t.Fatalf("purging a reference that isn't cached failed: %v", err)
+	}
+	if err := (&sources.ShubConveyorPacker{}).PurgeCache("shub://username/container:tag"); err == nil {
+		t.Fatalf("purged without cache")
+	}
+}
+
+// TestFileCacheMode checks the permissions of cache entries, restricted by
+// the umask
+func TestFileCacheMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+
+	for _, tt := range []struct {
+		mode     os.FileMode
+		expected os.FileMode
+	}{
+		{0, 0600},
+		{0644, 0644 &^ os.FileMode(umask)},
+		{0666, 0666 &^ os.FileMode(umask)},
+	} {
+		cache := sources.NewFileCache(dir)
+		cache.Mode = tt.mode
+		if err := cache.Put("entry", strings.NewReader("content")); err != nil {
+			t.Fatalf("unable to put entry: %v", err)
+		}
+
+		path, err := cache.Path("entry")
+		if err != nil {
+			t.Fatalf("unable to get entry path: %v", err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("unable to stat entry: %v", err)
+		}
+		if perm := fi.Mode().Perm(); perm != tt.expected {
+			t.Errorf("unexpected permissions %v of entry with mode %v, expected %v", perm, tt.mode, tt.expected)
+		}
+	}
+}
+
+// TestFileCacheStats checks that rejected entries count as misses
+func TestFileCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-cache-")
+	if err != nil {
+		t.Fatalf("unable to create cache directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := sources.NewFileCache(dir)
+	if err := c.Put("shub/username/container/latest", strings.NewReader("image")); err != nil {
+		t.Fatalf("failed to put cache entry: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		reject bool
+		stats  sources.CacheStats
+	}{
+		{"Hit", "shub/username/container/latest", false, sources.CacheStats{Hits: 1, Misses: 0}},
+		{"Miss", "shub/username/container/other", false, sources.CacheStats{Hits: 1, Misses: 1}},
+		{"Rejected", "shub/username/container/latest", true, sources.CacheStats{Hits: 1, Misses: 2}},
+	}
+
+	for _, tt := range tests {
+		if r, ok := c.Get(tt.key); ok {
+			r.Close()
+			if tt.reject {
+				c.Reject(tt.key)
+			}
+		}
+		if stats := c.Stats(); stats != tt.stats {
+			t.Fatalf("%s: got statistics %+v, expected %+v", tt.name, stats, tt.stats)
+		}
+	}
+	if rate := c.Stats().HitRate(); rate < 0.33 || rate > 0.34 {
+		t.Fatalf("unexpected hit rate %v", rate)
+	}
+}
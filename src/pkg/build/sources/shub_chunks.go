@@ -0,0 +1,264 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+const (
+	// minChunkSize is the smallest chunk downloaded when tuning automatically,
+	// smaller images being downloaded in a single request
+	minChunkSize = 8 << 20
+	// maxAutoChunks bounds the chunks downloaded at once when tuning automatically
+	maxAutoChunks = 8
+)
+
+// AutoChunks sets Chunks to be tuned from the image size and the measured
+// throughput
+const AutoChunks = -1
+
+// ChunkVerifier checks a chunk of the image downloaded in parallel, from
+// byte start to end included, given the headers of its range response, e.g.
+// against a digest of the range exposed by the server. content reads the
+// chunk as written to disk
+type ChunkVerifier func(start, end int64, header http.Header, content io.Reader) error
+
+// chunkVerifyError is returned for a chunk failing verification, which is
+// downloaded again
+type chunkVerifyError struct {
+	c   chunk
+	err error
+}
+
+func (e *chunkVerifyError) Error() string {
+	return fmt.Sprintf("chunk of %v bytes at offset %v failed verification: %v", e.c.size(), e.c.start, e.err)
+}
+
+// chunk is a byte range of the image, end included
+type chunk struct {
+	start, end int64
+}
+
+func (c chunk) size() int64 {
+	return c.end - c.start + 1
+}
+
+// splitChunks splits size bytes into chunks of chunkSize bytes, the last one
+// holding the remainder
+func splitChunks(size, chunkSize int64) []chunk {
+	var chunks []chunk
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		chunks = append(chunks, chunk{start, end})
+	}
+	return chunks
+}
+
+// chunkTuner adjusts the number of chunks downloaded at once: starting with
+// a conservative number, a chunk is added as long as the throughput measured
+// over a round of downloads improves noticeably, up to max
+type chunkTuner struct {
+	workers int
+	max     int
+	best    float64
+	settled bool
+}
+
+// observe records the throughput, in bytes per second, of the last round and
+// reports whether a chunk should be added
+func (t *chunkTuner) observe(throughput float64) bool {
+	if t.settled || t.workers >= t.max {
+		return false
+	}
+
+	if t.best > 0 && throughput < t.best*1.1 {
+		t.settled = true
+		return false
+	}
+
+	t.best = throughput
+	t.workers++
+	return true
+}
+
+// offsetWriter writes sequentially into f from offset
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// rangeSize returns the size of the image when the server accepts range
+// requests for it, or -1
+func (cp *ShubConveyorPacker) rangeSize(ctx context.Context) (int64, error) {
+	resp, err := cp.requestImage(ctx, http.MethodHead, "", "")
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return -1, nil
+	}
+	return resp.ContentLength, nil
+}
+
+// downloadChunked downloads the image referenced by the manifest into dst
+// with parallel range requests, as configured by Chunks. It returns false,
+// without writing dst, when the image has to be downloaded in a single request
+func (cp *ShubConveyorPacker) downloadChunked(ctx context.Context, dst *os.File) (int64, bool, error) {
+	if (cp.Chunks <= 1 && cp.Chunks != AutoChunks) || cp.Decompress || cp.SkipSizeCheck || cp.PartialDir != "" {
+		return 0, false, nil
+	}
+
+	size, err := cp.rangeSize(ctx)
+	if err != nil || size <= 0 {
+		sylog.Debugf("Server doesn't announce range requests support, downloading in a single request")
+		return 0, false, nil
+	}
+	if err := cp.checkImageSize(size); err != nil {
+		return 0, true, err
+	}
+
+	var chunks []chunk
+	tuner := &chunkTuner{workers: cp.Chunks, max: cp.Chunks}
+	if cp.Chunks != AutoChunks {
+		chunkSize := (size + int64(cp.Chunks) - 1) / int64(cp.Chunks)
+		chunks = splitChunks(size, chunkSize)
+	} else {
+		if size < 2*minChunkSize {
+			return 0, false, nil
+		}
+		chunkSize := size / (maxAutoChunks * 4)
+		if chunkSize < minChunkSize {
+			chunkSize = minChunkSize
+		}
+		chunks = splitChunks(size, chunkSize)
+		tuner = &chunkTuner{workers: 2, max: maxAutoChunks}
+	}
+
+	if err := dst.Truncate(size); err != nil {
+		return 0, true, err
+	}
+	sylog.Debugf("Downloading %v bytes in %d chunks, %d at once", size, len(chunks), tuner.workers)
+
+	if err := cp.downloadChunks(ctx, dst, chunks, tuner); err != nil {
+		return 0, true, err
+	}
+	if err := checkNotHTML(dst); err != nil {
+		return size, true, err
+	}
+
+	return size, true, nil
+}
+
+// downloadChunks downloads chunks into dst, as many at once as the tuner allows
+func (cp *ShubConveyorPacker) downloadChunks(ctx context.Context, dst *os.File, chunks []chunk, tuner *chunkTuner) error {
+	// workers are stopped before being waited for
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pending := make(chan chunk, len(chunks))
+	for _, c := range chunks {
+		pending <- c
+	}
+	close(pending)
+
+	type result struct {
+		size int64
+		err  error
+	}
+	results := make(chan result, len(chunks))
+
+	worker := func() {
+		defer wg.Done()
+		for c := range pending {
+			err := cp.retry(ctx, "Image chunk download", func() error {
+				return cp.downloadChunk(ctx, dst, c)
+			})
+			results <- result{c.size(), err}
+		}
+	}
+	for i := 0; i < tuner.workers; i++ {
+		wg.Add(1)
+		go worker()
+	}
+
+	var roundBytes int64
+	roundDone := 0
+	roundStart := time.Now()
+	for range chunks {
+		r := <-results
+		if r.err != nil {
+			return r.err
+		}
+
+		roundBytes += r.size
+		if roundDone++; roundDone < tuner.workers {
+			continue
+		}
+		if tuner.observe(float64(roundBytes) / time.Since(roundStart).Seconds()) {
+			sylog.Debugf("Increasing chunks downloaded at once to %d", tuner.workers)
+			wg.Add(1)
+			go worker()
+		}
+		roundBytes, roundDone, roundStart = 0, 0, time.Now()
+	}
+
+	return nil
+}
+
+// downloadChunk downloads the byte range of c into dst
+func (cp *ShubConveyorPacker) downloadChunk(ctx context.Context, dst *os.File, c chunk) error {
+	resp, err := cp.requestImage(ctx, http.MethodGet, fmt.Sprintf("bytes=%d-%d", c.start, c.end), "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != c.size() {
+		return fmt.Errorf("received %v bytes for chunk of %v bytes at offset %v", resp.ContentLength, c.size(), c.start)
+	}
+
+	body, stop := cp.watchStall(resp.Body)
+	defer stop()
+	n, err := io.Copy(&offsetWriter{f: dst, off: c.start}, io.LimitReader(body, c.size()))
+	if err != nil {
+		return err
+	}
+	if n != c.size() {
+		return io.ErrUnexpectedEOF
+	}
+
+	if cp.VerifyChunk != nil {
+		if err := cp.VerifyChunk(c.start, c.end, resp.Header, io.NewSectionReader(dst, c.start, c.size())); err != nil {
+			return &chunkVerifyError{c: c, err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testChunked downloads content with the given number of chunks from a server
+// supporting range requests, returning whether it was chunked and the number
+// of range requests received
+func testChunked(t *testing.T, content []byte, chunks int) (bool, int64) {
+	var ranges int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt64(&ranges, 1)
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-chunks-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{Chunks: chunks}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	n, chunked, err := cp.downloadChunked(context.Background(), f)
+	if err != nil {
+		t.Fatalf("failed to download image in %d chunks: %v", chunks, err)
+	}
+	if !chunked {
+		return false, ranges
+	}
+
+	received, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read downloaded image: %v", err)
+	}
+	if n != int64(len(content)) || !bytes.Equal(received, content) {
+		t.Fatalf("image of %d bytes in %d chunks reassembled incorrectly, received %d bytes", len(content), chunks, n)
+	}
+	return true, ranges
+}
+
+// TestDownloadChunked checks the reassembly of images downloaded in a fixed number of chunks
+func TestDownloadChunked(t *testing.T) {
+	for _, size := range []int{1, 10, 1000, 4097} {
+		content := make([]byte, size)
+		rand.Read(content)
+		// images are never served as HTML, whatever the random content
+		content[0] = 0
+
+		for _, chunks := range []int{2, 3, 7, 16} {
+			t.Run(fmt.Sprintf("%dBytes%dChunks", size, chunks), func(t *testing.T) {
+				chunked, ranges := testChunked(t, content, chunks)
+				if !chunked {
+					t.Fatalf("image wasn't downloaded in chunks")
+				}
+				chunkSize := (size + chunks - 1) / chunks
+				expected := int64((size + chunkSize - 1) / chunkSize)
+				if ranges != expected {
+					t.Fatalf("unexpected %d range requests, expected %d", ranges, expected)
+				}
+			})
+		}
+	}
+}
+
+// TestDownloadChunkedAuto checks that chunks are only used automatically for
+// large images, and never by default
+func TestDownloadChunkedAuto(t *testing.T) {
+	if chunked, _ := testChunked(t, []byte(testImageContent), AutoChunks); chunked {
+		t.Fatalf("small image was downloaded in chunks")
+	}
+	if chunked, _ := testChunked(t, []byte(testImageContent), 1); chunked {
+		t.Fatalf("image was downloaded in chunks with chunks disabled")
+	}
+
+	content := make([]byte, 2*minChunkSize+12345)
+	rand.Read(content)
+	content[0] = 0
+	if chunked, _ := testChunked(t, content, 0); chunked {
+		t.Fatalf("large image was downloaded in chunks by default")
+	}
+	chunked, ranges := testChunked(t, content, AutoChunks)
+	if !chunked {
+		t.Fatalf("large image wasn't downloaded in chunks")
+	}
+	if ranges != 3 {
+		t.Fatalf("unexpected %d range requests, expected 3", ranges)
+	}
+}
+
+// TestChunkTuner checks that chunks are added while the throughput improves
+func TestChunkTuner(t *testing.T) {
+	tuner := &chunkTuner{workers: 2, max: 4}
+
+	for _, step := range []struct {
+		throughput float64
+		grow       bool
+		workers    int
+	}{
+		{100, true, 3},
+		{150, true, 4},
+		{300, false, 4},
+	} {
+		if grow := tuner.observe(step.throughput); grow != step.grow || tuner.workers != step.workers {
+			t.Fatalf("unexpected tuning for throughput %v: grow=%v workers=%d", step.throughput, grow, tuner.workers)
+		}
+	}
+
+	tuner = &chunkTuner{workers: 2, max: 8}
+	tuner.observe(100)
+	if tuner.observe(105) || tuner.observe(1000) || tuner.workers != 3 {
+		t.Fatalf("tuner kept adding chunks once the throughput stopped improving")
+	}
+
+	fixed := &chunkTuner{workers: 4, max: 4}
+	if fixed.observe(100) {
+		t.Fatalf("fixed number of chunks was tuned")
+	}
+}
+
+// TestDownloadChunkVerify checks that only the chunk failing verification is downloaded again
+func TestDownloadChunkVerify(t *testing.T) {
+	content := make([]byte, 4000)
+	rand.Read(content)
+	content[0] = 0
+
+	var corrupted int32
+	requests := make(map[string]int)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" {
+			mu.Lock()
+			requests[rng]++
+			mu.Unlock()
+
+			var start, end int
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			sum := md5.Sum(content[start : end+1])
+			w.Header().Set("Content-MD5", hex.EncodeToString(sum[:]))
+			// the first response to the second chunk is corrupted on the way
+			if start > 0 && atomic.CompareAndSwapInt32(&corrupted, 0, 1) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(make([]byte, end-start+1))
+				return
+			}
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-chunks-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{Chunks: 2, Retries: 1}
+	cp.VerifyChunk = func(start, end int64, header http.Header, r io.Reader) error {
+		h := md5.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != header.Get("Content-MD5") {
+			return fmt.Errorf("digest %s doesn't match %s", sum, header.Get("Content-MD5"))
+		}
+		return nil
+	}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	if _, _, err := cp.downloadChunked(context.Background(), f); err != nil {
+		t.Fatalf("failed to download image: %v", err)
+	}
+	received, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read downloaded image: %v", err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("corrupt chunk wasn't downloaded again")
+	}
+	if requests["bytes=0-1999"] != 1 || requests["bytes=2000-3999"] != 2 {
+		t.Fatalf("unexpected range requests %v", requests)
+	}
+}
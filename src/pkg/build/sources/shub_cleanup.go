@@ -0,0 +1,55 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// removeTemp removes the temporary directory dir created within root,
+// resolving symlinks in both first. dir is left in place when it is itself a
+// symlink or doesn't resolve within root, so a tampered tree can't lead to
+// removing anything else. Symlinks within dir are removed, not followed
+func removeTemp(dir, root string) error {
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to remove %s: it is a symlink", dir)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("refusing to remove %s: it isn't a directory", dir)
+	}
+
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+		return fmt.Errorf("refusing to remove %s: it resolves to %s, outside of %s", dir, resolved, root)
+	}
+
+	return os.RemoveAll(resolved)
+}
+
+// removeBundle removes the bundle directory created by NewBundle
+func removeBundle(dir string) {
+	if err := removeTemp(dir, os.TempDir()); err != nil {
+		sylog.Warningf("Could not remove bundle: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRemoveTemp checks that temporary directories are only removed within their root
+func TestRemoveTemp(t *testing.T) {
+	base, err := ioutil.TempDir("", "shub-cleanup-")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(base)
+
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside, filepath.Join(root, "temp")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+	}
+
+	// a symlinked root is resolved
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	// symlinks within the directory are removed, not followed
+	if err := os.Symlink(outside, filepath.Join(root, "temp", "outside")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := removeTemp(filepath.Join(link, "temp"), link); err != nil {
+		t.Fatalf("failed to remove temporary directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "temp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary directory wasn't removed")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("symlink target was removed: %v", err)
+	}
+
+	// directories replaced by symlinks or outside of the root are kept
+	if err := os.Symlink(outside, filepath.Join(root, "temp")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := removeTemp(filepath.Join(root, "temp"), root); err == nil {
+		t.Fatalf("removed a symlinked temporary directory")
+	}
+	if err := removeTemp(outside, root); err == nil {
+		t.Fatalf("removed a directory outside of the root")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("directory outside of the root was removed: %v", err)
+	}
+
+	if err := removeTemp(filepath.Join(root, "missing"), root); err != nil {
+		t.Fatalf("failed to ignore missing directory: %v", err)
+	}
+}
+
+func TestBundlePrefix(t *testing.T) {
+	cp := &ShubConveyorPacker{}
+	if prefix, err := cp.bundlePrefix(); err != nil || prefix != defaultBundlePrefix {
+		t.Fatalf("unexpected default bundle prefix %q: %v", prefix, err)
+	}
+
+	cp.BundlePrefix = "job-1234"
+	if prefix, err := cp.bundlePrefix(); err != nil || prefix != "job-1234" {
+		t.Fatalf("unexpected bundle prefix %q: %v", prefix, err)
+	}
+
+	for _, prefix := range []string{"../job", "jobs/1234", `jobs\1234`} {
+		cp.BundlePrefix = prefix
+		if _, err := cp.bundlePrefix(); err == nil {
+			t.Fatalf("failed to catch invalid bundle prefix %q", prefix)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWithClockHint(t *testing.T) {
+	expired := &url.Error{Op: "Get", URL: "https://localhost", Err: x509.CertificateInvalidError{Reason: x509.Expired}}
+	err := withClockHint(expired)
+	if _, ok := err.(*clockError); !ok || !strings.Contains(err.Error(), "system clock") {
+		t.Fatalf("expired certificate error %v doesn't hint at the system clock", err)
+	}
+	if IsTransientError(err) {
+		t.Fatalf("expired certificate error is retried")
+	}
+
+	for _, other := range []error{
+		&url.Error{Op: "Get", URL: "https://localhost", Err: x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}},
+		&url.Error{Op: "Get", URL: "https://localhost", Err: x509.UnknownAuthorityError{}},
+		errors.New("connection refused"),
+		nil,
+	} {
+		if err := withClockHint(other); err != other {
+			t.Fatalf("unexpected clock hint for %v", other)
+		}
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	cp := &ShubConveyorPacker{}
+	transport, err := cp.newTransport("registry.example.org")
+	if err != nil {
+		t.Fatalf("unable to create transport: %v", err)
+	}
+	if transport.TLSNextProto != nil {
+		t.Fatalf("HTTP/2 disabled by default")
+	}
+
+	os.Setenv(shubDisableHTTP2Env, "true")
+	defer os.Unsetenv(shubDisableHTTP2Env)
+
+	cp = &ShubConveyorPacker{}
+	if transport, err = cp.newTransport("registry.example.org"); err != nil {
+		t.Fatalf("unable to create transport: %v", err)
+	}
+	if transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Fatalf("HTTP/2 wasn't disabled")
+	}
+	if protos := transport.TLSClientConfig.NextProtos; len(protos) != 1 || protos[0] != "http/1.1" {
+		t.Fatalf("unexpected protocols %v offered with HTTP/2 disabled", protos)
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	defer os.Unsetenv(shubMinTLSEnv)
+
+	tests := []struct {
+		name    string
+		env     string
+		version uint16
+		wantErr bool
+	}{
+		{"Default", "", tls.VersionTLS12, false},
+		{"TLS11", "1.1", tls.VersionTLS11, false},
+		{"TLS13", "1.3", tls.VersionTLS13, false},
+		{"Unknown", "1.4", 0, true},
+		{"Garbage", "tls12", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(shubMinTLSEnv, tt.env)
+
+			cp := &ShubConveyorPacker{}
+			version, err := cp.minTLSVersion()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if version != tt.version {
+				t.Fatalf("got version %#x, expected %#x", version, tt.version)
+			}
+			if _, err := cp.httpTransport("registry.example.org"); (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected transport error %v", err)
+			}
+		})
+	}
+}
+
+func TestMinTLSVersionRefused(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS11, MaxVersion: tls.VersionTLS11}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func() error {
+		cp := &ShubConveyorPacker{Insecure: true, IsolatedTransport: true}
+		transport, err := cp.httpTransport("127.0.0.1")
+		if err != nil {
+			t.Fatalf("unable to create transport: %v", err)
+		}
+		defer transport.CloseIdleConnections()
+
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+
+	if err := get(); err == nil {
+		t.Fatalf("TLS 1.1 server accepted under the TLS 1.2 default")
+	}
+
+	os.Setenv(shubMinTLSEnv, "1.1")
+	defer os.Unsetenv(shubMinTLSEnv)
+	if err := get(); err != nil {
+		t.Fatalf("TLS 1.1 server refused with %s=1.1: %v", shubMinTLSEnv, err)
+	}
+}
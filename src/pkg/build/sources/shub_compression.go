@@ -0,0 +1,52 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// magic numbers of the compression formats an image may be served with
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// decompressReader detects the compression of r from its magic bytes and
+// returns a reader of the decompressed content. Content which isn't
+// compressed is returned as is
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		sylog.Debugf("Decompressing gzip compressed image")
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		sylog.Debugf("Decompressing bzip2 compressed image")
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil, fmt.Errorf("zstd compressed images are not supported")
+	case bytes.HasPrefix(magic, xzMagic):
+		return nil, fmt.Errorf("xz compressed images are not supported")
+	}
+
+	return br, nil
+}
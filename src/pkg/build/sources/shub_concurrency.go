@@ -0,0 +1,75 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// shubMaxDownloadsEnv holds the number of images downloaded at once by all
+// packers of the process, the number of CPUs by default
+const shubMaxDownloadsEnv = "SINGULARITY_SHUB_MAX_DOWNLOADS"
+
+// downloadSlots bounds the downloads active at once across all packers, so
+// builds pulling many images don't overwhelm the disk and the network
+var downloadSlots = struct {
+	sync.Mutex
+	slots chan struct{}
+}{}
+
+// SetMaxConcurrentDownloads sets the number of images downloaded at once by
+// all packers, overriding SINGULARITY_SHUB_MAX_DOWNLOADS. A limit below 1
+// restores the default. Downloads already active keep their slot
+func SetMaxConcurrentDownloads(n int) {
+	if n < 1 {
+		n = defaultMaxDownloads()
+	}
+
+	downloadSlots.Lock()
+	downloadSlots.slots = make(chan struct{}, n)
+	downloadSlots.Unlock()
+}
+
+func defaultMaxDownloads() int {
+	if env := os.Getenv(shubMaxDownloadsEnv); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n > 0 {
+			return n
+		}
+		sylog.Warningf("Ignoring invalid %s value %q", shubMaxDownloadsEnv, env)
+	}
+	return runtime.NumCPU()
+}
+
+// acquireDownload waits for a download slot, returning the function
+// releasing it
+func acquireDownload(ctx context.Context) (func(), error) {
+	downloadSlots.Lock()
+	if downloadSlots.slots == nil {
+		downloadSlots.slots = make(chan struct{}, defaultMaxDownloads())
+	}
+	slots := downloadSlots.slots
+	downloadSlots.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	default:
+	}
+
+	sylog.Debugf("%d downloads already active, waiting for a slot", cap(slots))
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
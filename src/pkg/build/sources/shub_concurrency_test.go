@@ -0,0 +1,41 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestAcquireDownload checks that no more downloads than the limit are active at once
+func TestAcquireDownload(t *testing.T) {
+	SetMaxConcurrentDownloads(2)
+	defer SetMaxConcurrentDownloads(0)
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := acquireDownload(context.Background())
+		if err != nil {
+			t.Fatalf("failed to acquire download slot %d: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquireDownload(ctx); err == nil {
+		t.Fatalf("acquired a download slot beyond the limit")
+	}
+
+	releases[0]()
+	release, err := acquireDownload(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire released download slot: %v", err)
+	}
+	release()
+	releases[1]()
+}
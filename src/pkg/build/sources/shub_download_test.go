@@ -0,0 +1,607 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+const testImageContent = "hsqs fake squashfs image content"
+
+// testDownload downloads the image served by handler into a temporary file
+// and returns the content received
+func testDownload(t *testing.T, cp *ShubConveyorPacker, handler http.HandlerFunc) (string, error) {
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+	if _, err := cp.downloadImage(context.Background(), f); err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read downloaded image: %v", err)
+	}
+	return string(content), nil
+}
+
+// TestDownloadImageNoContentLength checks that images served without a length
+// and terminated by closing the connection are accepted
+func TestDownloadImageNoContentLength(t *testing.T) {
+	content, err := testDownload(t, &ShubConveyorPacker{}, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("unable to hijack connection: %v", err)
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n" + testImageContent)
+		buf.Flush()
+	})
+	if err != nil {
+		t.Fatalf("failed to download image without length: %v", err)
+	}
+	if content != testImageContent {
+		t.Fatalf("unexpected image content %q", content)
+	}
+}
+
+// TestDownloadImageInvalid checks that empty and HTML responses are rejected
+func TestDownloadImageInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"Empty", ""},
+		{"HTML", "<!DOCTYPE html><html><body>Not Found</body></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testDownload(t, &ShubConveyorPacker{}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write([]byte(tt.body))
+			})
+			if err == nil {
+				t.Fatalf("failed to reject %s image", tt.name)
+			}
+		})
+	}
+}
+
+// TestDownloadImageRedirectHosts checks that redirects are restricted to the allowed hosts
+func TestDownloadImageRedirectHosts(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if host, port, _ := net.SplitHostPort(r.Host); host == "127.0.0.1" {
+			http.Redirect(w, r, "http://localhost:"+port+"/image", http.StatusFound)
+			return
+		}
+		w.Write([]byte(testImageContent))
+	}
+
+	if _, err := testDownload(t, &ShubConveyorPacker{RedirectHosts: []string{"127.0.0.1"}}, handler); err == nil {
+		t.Fatalf("failed to reject redirect to disallowed host")
+	}
+
+	content, err := testDownload(t, &ShubConveyorPacker{RedirectHosts: []string{"127.0.0.1", "localhost"}}, handler)
+	if err != nil {
+		t.Fatalf("failed to follow redirect to allowed host: %v", err)
+	}
+	if content != testImageContent {
+		t.Fatalf("unexpected image content %q", content)
+	}
+}
+
+// TestDownloadImageResume checks that a download interrupted by the server
+// closing the connection is resumed from where it stopped, guarded by the
+// Last-Modified date of the image
+func TestDownloadImageResume(t *testing.T) {
+	modified := time.Unix(1500000000, 0).UTC()
+	var ranges, ifRanges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		if len(ranges) > 1 {
+			http.ServeContent(w, r, "", modified, strings.NewReader(testImageContent))
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("unable to hijack connection: %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nLast-Modified: %s\r\nContent-Length: %d\r\n\r\n%s", modified.Format(http.TimeFormat), len(testImageContent), testImageContent[:10])
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	_, err = cp.downloadImage(context.Background(), f)
+	if !IsTransientError(err) {
+		t.Fatalf("interrupted download isn't retried: %v", err)
+	}
+
+	n, err := cp.downloadImage(context.Background(), f)
+	if err != nil {
+		t.Fatalf("failed to resume download: %v", err)
+	}
+	if n != int64(len(testImageContent)) {
+		t.Fatalf("unexpected size %v of resumed download", n)
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes=10-" {
+		t.Fatalf("download wasn't resumed, requested ranges %q", ranges)
+	}
+	if ifRanges[1] != modified.Format(http.TimeFormat) {
+		t.Fatalf("resumed download not guarded by the Last-Modified date, If-Range %q", ifRanges[1])
+	}
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read downloaded image: %v", err)
+	}
+	if string(content) != testImageContent {
+		t.Fatalf("unexpected image content %q", content)
+	}
+}
+
+// TestDownloadImageRestart checks that a download interrupted before the
+// server identified the image version is restarted rather than resumed, as
+// the image could have changed
+func TestDownloadImageRestart(t *testing.T) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) > 1 {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testImageContent))
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("unable to hijack connection: %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(testImageContent), "stale data")
+		buf.Flush()
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	if _, err = cp.downloadImage(context.Background(), f); !IsTransientError(err) {
+		t.Fatalf("interrupted download isn't retried: %v", err)
+	}
+	if _, err := cp.downloadImage(context.Background(), f); err != nil {
+		t.Fatalf("failed to restart download: %v", err)
+	}
+	if len(ranges) != 2 || ranges[1] != "" {
+		t.Fatalf("download without validator was resumed, requested ranges %q", ranges)
+	}
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read downloaded image: %v", err)
+	}
+	if string(content) != testImageContent {
+		t.Fatalf("unexpected image content %q", content)
+	}
+}
+
+// TestDownloadImageStall checks that a download receiving no bytes for the
+// StallTimeout is aborted, and resumed when retried
+func TestDownloadImageStall(t *testing.T) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if len(ranges) > 1 {
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testImageContent))
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(testImageContent)))
+		io.WriteString(w, testImageContent[:10])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{StallTimeout: 200 * time.Millisecond}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	_, err = cp.downloadImage(context.Background(), f)
+	if _, ok := err.(*stallError); !ok || !IsTransientError(err) {
+		t.Fatalf("stalled download wasn't aborted to be retried: %v", err)
+	}
+
+	cp.Retries = 1
+	n, err := cp.downloadResumable(context.Background(), f, nil)
+	if err != nil {
+		t.Fatalf("failed to resume download: %v", err)
+	}
+	if n != int64(len(testImageContent)) {
+		t.Fatalf("unexpected size %v of resumed download", n)
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes=10-" {
+		t.Fatalf("download wasn't resumed, requested ranges %q", ranges)
+	}
+}
+
+// TestDownloadImageLog checks that the requests of a pull are recorded in its log file
+func TestDownloadImageLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-log-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cp := &ShubConveyorPacker{LogFile: dir + "/pull.log"}
+	if err := cp.openLog(); err != nil {
+		t.Fatalf("failed to create pull log: %v", err)
+	}
+	_, err = testDownload(t, cp, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testImageContent))
+	})
+	cp.closeLog(err)
+	if err != nil {
+		t.Fatalf("failed to download image: %v", err)
+	}
+
+	log, err := ioutil.ReadFile(cp.LogFile)
+	if err != nil {
+		t.Fatalf("unable to read pull log: %v", err)
+	}
+	for _, record := range []string{"pull started", "/image: 200 OK", "pull succeeded"} {
+		if !strings.Contains(string(log), record) {
+			t.Fatalf("pull log doesn't record %q:\n%s", record, log)
+		}
+	}
+}
+
+// TestDownloadImageDigestMismatch checks that an image failing verification is
+// removed and reported with both digests
+func TestDownloadImageDigestMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testImageContent))
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	expected := "00000000000000000000000000000000"
+	cp := &ShubConveyorPacker{}
+	if cp.srcURI, err = ShubParseReference("//username/container@" + expected); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	err = cp.downloadToFile(context.Background(), f, "")
+	if err == nil {
+		t.Fatalf("failed to catch digest mismatch")
+	}
+	if !strings.Contains(err.Error(), "expected "+expected) || !strings.Contains(err.Error(), "got ") {
+		t.Fatalf("error %q doesn't name the expected and actual digests", err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Fatalf("image failing verification wasn't removed")
+	}
+}
+
+func TestDownloadImagePartial(t *testing.T) {
+	const etag = `"v1"`
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "image", time.Time{}, strings.NewReader(testImageContent))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "shub-partial-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "shub-download-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cp := &ShubConveyorPacker{PartialDir: dir}
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	// seed the partial download left by a previous process
+	path, metaPath := cp.partialPaths()
+	if err := ioutil.WriteFile(path, []byte(testImageContent[:10]), 0600); err != nil {
+		t.Fatalf("unable to write partial download: %v", err)
+	}
+	meta := fmt.Sprintf(`{"url": %q, "bytes": 10, "etag": %q}`, cp.downloadURL(), etag)
+	if err := ioutil.WriteFile(metaPath, []byte(meta), 0600); err != nil {
+		t.Fatalf("unable to write partial download sidecar: %v", err)
+	}
+
+	if err := cp.downloadToFile(context.Background(), f, ""); err != nil {
+		t.Fatalf("unable to download image: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=10-" {
+		t.Errorf("partial download wasn't resumed, requested ranges %q", ranges)
+	}
+
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+	if string(content) != testImageContent {
+		t.Errorf("unexpected image content %q", content)
+	}
+	for _, p := range []string{path, metaPath} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("completed partial download %s wasn't removed", p)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	cp := &ShubConveyorPacker{Retries: 5, RetryBudget: 1}
+
+	attempts := 0
+	failing := func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	}
+
+	// the manifest and image requests share the budget of the pull
+	if err := cp.retry(context.Background(), "Manifest request", failing); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := cp.retry(context.Background(), "Image download", failing); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("unexpected %d attempts with a retry budget of 1, expected 3", attempts)
+	}
+}
+
+func TestResolveImageURL(t *testing.T) {
+	base := url.URL{Scheme: "https", Host: "registry.example.org", Path: "/api/container/username/container:tag"}
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"https://storage.example.org/image.simg", "https://storage.example.org/image.simg"},
+		{"/images/username/container.simg", "https://registry.example.org/images/username/container.simg"},
+		{"images/container.simg", "https://registry.example.org/api/container/username/images/container.simg"},
+		{"//storage.example.org/image.simg", "https://storage.example.org/image.simg"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		image, err := resolveImageURL(base, tt.image)
+		if err != nil {
+			t.Fatalf("unable to resolve %q: %v", tt.image, err)
+		}
+		if image != tt.expected {
+			t.Errorf("unexpected image URL %s for %q, expected %s", image, tt.image, tt.expected)
+		}
+	}
+
+	if _, err := resolveImageURL(base, "%zz"); err == nil {
+		t.Fatalf("failed to catch invalid image URL")
+	}
+}
+
+// TestDownloadImageHeaders checks that custom headers are sent to the
+// registry, and dropped on redirects to another host
+func TestDownloadImageHeaders(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if project := r.Header.Get("X-Registry-Project"); project != "" {
+			t.Errorf("custom header sent to storage host: %s", project)
+		}
+		io.WriteString(w, testImageContent)
+	}))
+	defer storage.Close()
+
+	var project string
+	cp := &ShubConveyorPacker{Headers: http.Header{"X-Registry-Project": {"builds"}}}
+	content, err := testDownload(t, cp, func(w http.ResponseWriter, r *http.Request) {
+		project = r.Header.Get("X-Registry-Project")
+		http.Redirect(w, r, storage.URL+"/image", http.StatusFound)
+	})
+	if err != nil {
+		t.Fatalf("failed to download image: %v", err)
+	}
+	if content != testImageContent {
+		t.Fatalf("unexpected image content %q", content)
+	}
+	if project != "builds" {
+		t.Fatalf("custom header wasn't sent to the registry, got %q", project)
+	}
+
+	req, err := cp.newManifestRequest(cp.srcURI)
+	if err != nil {
+		t.Fatalf("unable to create manifest request: %v", err)
+	}
+	if project := req.Header.Get("X-Registry-Project"); project != "builds" {
+		t.Fatalf("custom header missing from manifest request, got %q", project)
+	}
+
+	cp.Headers.Set("authorization", "Bearer token")
+	if err := cp.checkHeaders(); err == nil {
+		t.Fatalf("failed to reject reserved header")
+	}
+}
+
+// TestStreamMaxImageSize checks that streams fail on images exceeding the
+// maximum size instead of being truncated
+func TestStreamMaxImageSize(t *testing.T) {
+	var announce bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if announce {
+			w.Header().Set("Content-Length", fmt.Sprint(len(testImageContent)))
+		}
+		w.(http.Flusher).Flush()
+		io.WriteString(w, testImageContent)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "shub-stream-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the reference is pinned so it resolves without a registry
+	lock := &Lockfile{Images: map[string]LockedImage{
+		"singularity-hub.org/api/container/username/container:latest": {Image: srv.URL + "/image", Digest: "00000000000000000000000000000000"},
+	}}
+	lockfile := filepath.Join(dir, "shub.lock")
+	if err := lock.write(lockfile); err != nil {
+		t.Fatalf("unable to write lockfile: %v", err)
+	}
+	recipe := sytypes.Definition{Header: map[string]string{"from": "username/container"}}
+	cp := &ShubConveyorPacker{Lockfile: lockfile, MaxImageSize: int64(len(testImageContent) - 1)}
+
+	stream, _, err := cp.Stream(context.Background(), recipe)
+	if err != nil {
+		t.Fatalf("unable to stream image: %v", err)
+	}
+	_, err = ioutil.ReadAll(stream)
+	stream.Close()
+	if err == nil {
+		t.Fatalf("oversized stream read without error")
+	}
+
+	announce = true
+	if stream, _, err := cp.Stream(context.Background(), recipe); err == nil {
+		stream.Close()
+		t.Fatalf("image announced oversized wasn't rejected")
+	}
+
+	cp.MaxImageSize = int64(len(testImageContent))
+	stream, _, err = cp.Stream(context.Background(), recipe)
+	if err != nil {
+		t.Fatalf("unable to stream image: %v", err)
+	}
+	defer stream.Close()
+	if content, err := ioutil.ReadAll(stream); err != nil || string(content) != testImageContent {
+		t.Fatalf("unexpected streamed content %q: %v", content, err)
+	}
+}
+
+// TestDownloadToFileMemory checks that images are downloaded into memory up
+// to MemoryImageSize, and larger ones to file with the same single request
+func TestDownloadToFileMemory(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testImageContent))
+	}))
+	defer srv.Close()
+
+	for _, limit := range []int64{int64(len(testImageContent)), int64(len(testImageContent) - 1)} {
+		f, err := ioutil.TempFile("", "shub-download-")
+		if err != nil {
+			t.Fatalf("unable to create temporary file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		requests = 0
+		cp := &ShubConveyorPacker{MemoryImageSize: limit}
+		if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+			t.Fatalf("unable to parse reference: %v", err)
+		}
+		cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+		if err := cp.downloadToFile(context.Background(), f, ""); err != nil {
+			t.Fatalf("failed to download image with memory limit %d: %v", limit, err)
+		}
+		if requests != 1 {
+			t.Errorf("image downloaded with %d requests with memory limit %d", requests, limit)
+		}
+		content, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("unable to read downloaded image: %v", err)
+		}
+		if string(content) != testImageContent {
+			t.Fatalf("unexpected image content %q with memory limit %d", content, limit)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// ErrDryRun is returned by pulls with DryRun set, once the requests they
+// would send are logged
+var ErrDryRun = errors.New("dry run, no request was sent")
+
+// secretHeaders are the headers redacted from dry run requests
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// DryRunRequest is a request a pull would send
+type DryRunRequest struct {
+	// Method is the HTTP method of the request
+	Method string
+	// URL is the address of the request, without password
+	URL string
+	// Header holds the headers of the request, with credentials redacted
+	Header http.Header
+}
+
+func (r DryRunRequest) String() string {
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := make([]string, len(keys))
+	for i, k := range keys {
+		headers[i] = k + ": " + strings.Join(r.Header[k], ", ")
+	}
+	return fmt.Sprintf("%s %s [%s]", r.Method, r.URL, strings.Join(headers, "; "))
+}
+
+// newDryRunRequest describes req, redacting its secrets
+func newDryRunRequest(req *http.Request) DryRunRequest {
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	for _, k := range secretHeaders {
+		if header.Get(k) != "" {
+			header.Set(k, "xxxxx")
+		}
+	}
+	return DryRunRequest{Method: req.Method, URL: redactURL(req.URL.String()), Header: header}
+}
+
+// DryRunRequests returns the requests a pull of recipe would send, without
+// sending any: the manifest requests to each registry and fallback tag in
+// the order they are tried, then the image request. The image URL is given
+// by the manifest, so the image request is only known for references pinned
+// by the Lockfile
+func (cp *ShubConveyorPacker) DryRunRequests(recipe sytypes.Definition) ([]DryRunRequest, error) {
+	if err := cp.parseRecipe(recipe); err != nil {
+		return nil, err
+	}
+	locked, err := cp.resolveLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []DryRunRequest
+	if !locked {
+		uris, err := cp.registries()
+		if err != nil {
+			return nil, err
+		}
+		for _, uri := range uris {
+			for _, tagged := range cp.manifestCandidates(uri) {
+				req, err := cp.newManifestRequest(tagged)
+				if err != nil {
+					return nil, err
+				}
+				requests = append(requests, newDryRunRequest(req))
+			}
+		}
+		return requests, nil
+	}
+
+	if cp.RewriteImageURL != nil {
+		if cp.imageURL, err = cp.RewriteImageURL(cp.manifest.Image); err != nil {
+			return nil, fmt.Errorf("failed to rewrite image URL: %v", err)
+		}
+	}
+	req, err := cp.newImageRequest(http.MethodGet, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return append(requests, newDryRunRequest(req)), nil
+}
+
+// manifestCandidates returns the references the manifest of base is
+// requested for, in order: by digest when base has one, otherwise for its
+// tag and then each fallback tag
+func (cp *ShubConveyorPacker) manifestCandidates(base ShubURI) []ShubURI {
+	if base.digest != "" {
+		base.tag = ""
+		return []ShubURI{base}
+	}
+
+	uris := []ShubURI{base}
+	for _, tag := range cp.TagFallback {
+		if tag = strings.TrimPrefix(tag, `:`); tag != "" && `:`+tag != base.tag {
+			uri := base
+			uri.tag = `:` + tag
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// dryRun logs the requests a pull of recipe would send
+func (cp *ShubConveyorPacker) dryRun(recipe sytypes.Definition) error {
+	requests, err := cp.DryRunRequests(recipe)
+	if err != nil {
+		return err
+	}
+	for _, req := range requests {
+		sylog.Infof("Dry run: %s", req)
+	}
+	if !cp.locked {
+		sylog.Infof("Dry run: the image URL is given by the manifest")
+	}
+	return ErrDryRun
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/singularityware/singularity/src/pkg/build/sources"
+	"github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+// TestShubDryRun checks the requests reported by a dry run, without network access
+func TestShubDryRun(t *testing.T) {
+	def, err := types.NewDefinitionFromURI("shub://username/container:tag")
+	if err != nil {
+		t.Fatalf("unable to parse URI: %v", err)
+	}
+
+	cp := &sources.ShubConveyorPacker{
+		Username:    "user",
+		Password:    "secret",
+		Mirrors:     []string{"mirror.example.org"},
+		TagFallback: []string{"latest"},
+		DryRun:      true,
+	}
+
+	requests, err := cp.DryRunRequests(def)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+
+	expected := []string{
+		"https://www.singularity-hub.org/api/container/username/container:tag",
+		"https://www.singularity-hub.org/api/container/username/container:latest",
+		"https://mirror.example.org/username/container:tag",
+		"https://mirror.example.org/username/container:latest",
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	for i, req := range requests {
+		if req.Method != "GET" || req.URL != expected[i] {
+			t.Errorf("unexpected request %s, expected GET %s", req, expected[i])
+		}
+		if req.Header.Get("Accept") == "" {
+			t.Errorf("request %s is missing the Accept header", req)
+		}
+		if strings.Contains(req.String(), "c2VjcmV0") || strings.Contains(req.URL, "secret") {
+			t.Errorf("request %s leaks credentials", req)
+		}
+	}
+	if auth := requests[0].Header.Get("Authorization"); auth != "xxxxx" {
+		t.Errorf("unexpected Authorization header %q, expected it redacted", auth)
+	}
+
+	if err := cp.Get(def); err != sources.ErrDryRun {
+		t.Fatalf("unexpected error %v for dry run pull, expected %v", err, sources.ErrDryRun)
+	}
+}
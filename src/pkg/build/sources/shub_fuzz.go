@@ -0,0 +1,41 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+//go:build gofuzz
+// +build gofuzz
+
+package sources
+
+import (
+	"fmt"
+)
+
+// Fuzz is the go-fuzz target of ShubParseReference, built with
+//
+//	go-fuzz-build -func Fuzz github.com/singularityware/singularity/src/pkg/build/sources
+//
+// Parsing must never panic, and a parsed reference must parse again from its
+// String and Canonical forms to the same reference
+func Fuzz(data []byte) int {
+	uri, err := ShubParseReference(string(data))
+	if err != nil {
+		return 0
+	}
+
+	for _, form := range []string{uri.String(), uri.Canonical()} {
+		again, err := ShubParseReference(`//` + form)
+		if err != nil {
+			panic(fmt.Sprintf("%q parsed to %q which doesn't parse: %v", data, form, err))
+		}
+		if again.Canonical() != uri.Canonical() {
+			panic(fmt.Sprintf("%q parsed to %q which parses to %q", data, form, again.Canonical()))
+		}
+	}
+	if again, _ := ShubParseReference(`//` + uri.String()); again.String() != uri.String() {
+		panic(fmt.Sprintf("%q parsed to %q which parses to %q", data, uri.String(), again.String()))
+	}
+
+	return 1
+}
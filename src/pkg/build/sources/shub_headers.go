@@ -0,0 +1,81 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reservedHeaders are set by the packer or the HTTP client and can't be
+// configured as custom Headers
+var reservedHeaders = []string{
+	"Accept", "Accept-Encoding", "Authorization", "Connection", "Content-Length",
+	"Content-Type", "Cookie", "Host", "If-Range", "Proxy-Authorization", "Range",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "User-Agent",
+}
+
+// headers returns the custom headers of requests to host, those of the
+// packer replacing those of the profile of host
+func (cp *ShubConveyorPacker) headers(host string) http.Header {
+	headers := make(http.Header)
+	if p, ok := cp.profile(host); ok {
+		for name, values := range p.Headers {
+			headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for name, values := range cp.Headers {
+		headers[http.CanonicalHeaderKey(name)] = values
+	}
+	return headers
+}
+
+// checkHeaders rejects custom headers reserved by the packer, whether set
+// on the packer or on a registry profile
+func (cp *ShubConveyorPacker) checkHeaders() error {
+	all := []http.Header{cp.Headers}
+	for _, p := range cp.RegistryProfiles {
+		all = append(all, p.Headers)
+	}
+
+	for _, headers := range all {
+		for name := range headers {
+			name = http.CanonicalHeaderKey(name)
+			for _, reserved := range reservedHeaders {
+				if name == reserved {
+					return fmt.Errorf("header %s is reserved and can't be set on shub requests", name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setHeaders adds the custom headers to req
+func (cp *ShubConveyorPacker) setHeaders(req *http.Request) {
+	for name, values := range cp.headers(req.URL.Hostname()) {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
+
+// redirectHeaders drops the custom headers from requests redirected to
+// another host, like the HTTP client does for credentials, as storage
+// services may reject unexpected headers, e.g. on signed URLs
+func (cp *ShubConveyorPacker) redirectHeaders(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		for name := range cp.headers(via[0].URL.Hostname()) {
+			req.Header.Del(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// Lockfile pins shub references to the image they resolved to, so builds
+// are reproducible. It is stored as JSON, e.g.
+//
+//	{
+//	  "images": {
+//	    "singularity-hub.org/api/container/user/container:latest": {
+//	      "image": "https://storage.example.org/user/container.simg",
+//	      "version": "...",
+//	      "digest": "0123456789abcdef0123456789abcdef"
+//	    }
+//	  }
+//	}
+//
+// Images are keyed by the canonical form of the reference as written in the
+// definition, before tag selection and fallback. A pinned reference is never
+// resolved with the registry: its image is downloaded from the pinned URL and
+// verified against the pinned md5 digest, which takes precedence over the
+// digest of the reference
+type Lockfile struct {
+	Images map[string]LockedImage `json:"images"`
+}
+
+// LockedImage is the image a reference is pinned to
+type LockedImage struct {
+	// Image is the URL the image is downloaded from
+	Image string `json:"image"`
+	// Version is the image version reported by the manifest
+	Version string `json:"version,omitempty"`
+	// Digest is the md5 digest of the image
+	Digest string `json:"digest"`
+}
+
+// readLockfile reads the lockfile at path, a missing lockfile being empty
+func readLockfile(path string) (*Lockfile, error) {
+	lock := &Lockfile{Images: make(map[string]LockedImage)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read lockfile: %v", err)
+	}
+
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("could not decode lockfile %s: %v", path, err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[string]LockedImage)
+	}
+	return lock, nil
+}
+
+// write atomically replaces the lockfile at path with lock
+func (lock *Lockfile) write(path string) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("could not create lockfile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write lockfile: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write lockfile: %v", err)
+	}
+	if err := chmodWithUmask(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("could not set lockfile permissions: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// resolveLocked resolves the parsed reference from the lockfile, returning
+// whether it is pinned there
+func (cp *ShubConveyorPacker) resolveLocked() (bool, error) {
+	cp.locked = false
+	if cp.Lockfile == "" {
+		return false, nil
+	}
+
+	lock, err := readLockfile(cp.Lockfile)
+	if err != nil {
+		return false, err
+	}
+
+	cp.lockKey = cp.srcURI.Canonical()
+	locked, ok := lock.Images[cp.lockKey]
+	if !ok {
+		return false, nil
+	}
+	if locked.Image == "" || locked.Digest == "" {
+		return false, fmt.Errorf("lockfile entry of %s is missing its image or digest", cp.lockKey)
+	}
+
+	sylog.Infof("Using image %s pinned by lockfile for %s", locked.Digest, cp.lockKey)
+	cp.manifest = &shubAPIResponse{
+		Image:   locked.Image,
+		Tag:     strings.TrimPrefix(cp.srcURI.tag, `:`),
+		Version: locked.Version,
+	}
+	cp.srcURI.digest = `@` + locked.Digest
+	cp.locked = true
+
+	return true, nil
+}
+
+// lockImage pins the reference to the image downloaded to path in the
+// lockfile, when UpdateLockfile is set and the reference isn't pinned yet
+func (cp *ShubConveyorPacker) lockImage(path string) error {
+	if cp.Lockfile == "" || !cp.UpdateLockfile || cp.locked {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not compute image digest: %v", err)
+	}
+
+	lock, err := readLockfile(cp.Lockfile)
+	if err != nil {
+		return err
+	}
+	lock.Images[cp.lockKey] = LockedImage{
+		Image:   cp.manifest.Image,
+		Version: cp.manifest.Version,
+		Digest:  hex.EncodeToString(h.Sum(nil)),
+	}
+	if err := lock.write(cp.Lockfile); err != nil {
+		return err
+	}
+
+	sylog.Infof("Pinned %s in lockfile %s", cp.lockKey, cp.Lockfile)
+	cp.locked = true
+	return nil
+}
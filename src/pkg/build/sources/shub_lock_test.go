@@ -0,0 +1,163 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+func TestLockfileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-lock-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "shub.lock")
+	lock, err := readLockfile(path)
+	if err != nil {
+		t.Fatalf("unable to read missing lockfile: %v", err)
+	}
+	if lock.Images == nil || len(lock.Images) != 0 {
+		t.Fatalf("unexpected images %v in missing lockfile", lock.Images)
+	}
+
+	lock.Images["singularity-hub.org/api/container/username/container:latest"] = LockedImage{
+		Image:   "https://storage.example.org/username/container.simg",
+		Version: "v1",
+		Digest:  "0123456789abcdef0123456789abcdef",
+	}
+	lock.Images["registry.example.org/api/container/username/other:1.0"] = LockedImage{
+		Image:  "https://registry.example.org/username/other.simg",
+		Digest: "fedcba9876543210fedcba9876543210",
+	}
+	if err := lock.write(path); err != nil {
+		t.Fatalf("unable to write lockfile: %v", err)
+	}
+
+	read, err := readLockfile(path)
+	if err != nil {
+		t.Fatalf("unable to read lockfile: %v", err)
+	}
+	if !reflect.DeepEqual(read, lock) {
+		t.Fatalf("lockfile read back as %+v, expected %+v", read, lock)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatalf("unable to write lockfile: %v", err)
+	}
+	if read, err = readLockfile(path); err != nil || read.Images == nil {
+		t.Fatalf("unable to read lockfile without images: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatalf("unable to write lockfile: %v", err)
+	}
+	if _, err := readLockfile(path); err == nil {
+		t.Fatalf("invalid lockfile read without error")
+	}
+}
+
+func TestLockImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-lock-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image.simg")
+	if err := ioutil.WriteFile(image, []byte(testImageContent), 0644); err != nil {
+		t.Fatalf("unable to write image: %v", err)
+	}
+	lockfile := filepath.Join(dir, "shub.lock")
+
+	cp := &ShubConveyorPacker{Lockfile: lockfile, UpdateLockfile: true}
+	if cp.srcURI, err = ShubParseReference("//username/container:latest"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	if locked, err := cp.resolveLocked(); err != nil || locked {
+		t.Fatalf("reference pinned by missing lockfile: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: "https://storage.example.org/username/container.simg", Version: "v1"}
+	if err := cp.lockImage(image); err != nil {
+		t.Fatalf("unable to pin image: %v", err)
+	}
+
+	cp = &ShubConveyorPacker{Lockfile: lockfile}
+	if cp.srcURI, err = ShubParseReference("//username/container:latest"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	locked, err := cp.resolveLocked()
+	if err != nil || !locked {
+		t.Fatalf("pinned reference not resolved from lockfile: %v", err)
+	}
+
+	sum := md5.Sum([]byte(testImageContent))
+	if digest := `@` + hex.EncodeToString(sum[:]); cp.srcURI.digest != digest {
+		t.Fatalf("got pinned digest %s, expected %s", cp.srcURI.digest, digest)
+	}
+	if cp.manifest.Image != "https://storage.example.org/username/container.simg" || cp.manifest.Version != "v1" || cp.manifest.Tag != "latest" {
+		t.Fatalf("unexpected manifest %+v resolved from lockfile", cp.manifest)
+	}
+}
+
+func TestLockfileMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testImageContent)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "shub-lock-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockfile := filepath.Join(dir, "shub.lock")
+	recipe := sytypes.Definition{Header: map[string]string{"from": "username/container"}}
+	dest := filepath.Join(dir, "container.simg")
+
+	pull := func(image LockedImage) error {
+		lock := &Lockfile{Images: map[string]LockedImage{
+			"singularity-hub.org/api/container/username/container:latest": image,
+		}}
+		if err := lock.write(lockfile); err != nil {
+			t.Fatalf("unable to write lockfile: %v", err)
+		}
+		cp := &ShubConveyorPacker{Lockfile: lockfile}
+		return cp.Pull(recipe, dest, true)
+	}
+
+	if err := pull(LockedImage{Image: srv.URL + "/image", Digest: "00000000000000000000000000000000"}); err == nil {
+		t.Fatalf("image not matching the pinned digest pulled without error")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatalf("image not matching the pinned digest written to %s", dest)
+	}
+
+	if err := pull(LockedImage{Image: srv.URL + "/image"}); err == nil {
+		t.Fatalf("lockfile entry without digest accepted")
+	}
+
+	sum := md5.Sum([]byte(testImageContent))
+	if err := pull(LockedImage{Image: srv.URL + "/image", Digest: hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("unable to pull pinned image: %v", err)
+	}
+	if content, err := ioutil.ReadFile(dest); err != nil || string(content) != testImageContent {
+		t.Fatalf("unexpected pulled content %q: %v", content, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// openLog creates the LogFile of the pull, if any
+func (cp *ShubConveyorPacker) openLog() error {
+	if cp.LogFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(cp.LogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create pull log: %v", err)
+	}
+	cp.logw = f
+	cp.logf("pull started")
+
+	return nil
+}
+
+// closeLog records the outcome of the pull and closes the LogFile
+func (cp *ShubConveyorPacker) closeLog(err error) {
+	if cp.logw == nil {
+		return
+	}
+
+	if err != nil {
+		cp.logf("pull failed: %v", err)
+	} else {
+		cp.logf("pull succeeded")
+	}
+
+	if err := cp.logw.Close(); err != nil {
+		sylog.Warningf("Could not write pull log %s: %v", cp.LogFile, err)
+	}
+	cp.logw = nil
+}
+
+// logf appends a timestamped line to the LogFile of the pull in progress
+func (cp *ShubConveyorPacker) logf(format string, a ...interface{}) {
+	if cp.logw == nil {
+		return
+	}
+
+	fmt.Fprintf(cp.logw, "%s %s\n", time.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, a...))
+}
+
+// digestOrUnverified returns digest, or a placeholder when images aren't verified
+func digestOrUnverified(digest string) string {
+	if digest == "" {
+		return "unverified"
+	}
+	return digest
+}
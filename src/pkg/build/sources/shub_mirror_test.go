@@ -0,0 +1,161 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+// TestMirrorFallback checks that the manifest is requested from the primary
+// registry first, then from each distinct mirror in order, credentials being
+// only sent to the primary registry
+func TestMirrorFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-mirror-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every registry is served by the same test server through a unix
+	// socket, and told apart by the Host of the requests
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv(shubUnixSocketEnv, socket)
+	defer os.Unsetenv(shubUnixSocketEnv)
+
+	var mu sync.Mutex
+	var hosts []string
+	auth := make(map[string]bool)
+	serving := map[string]bool{"mirror2.example.org": true, "mirror3.example.org": true}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		hosts = append(hosts, host)
+		if r.Header.Get("Authorization") != "" {
+			auth[host] = true
+		}
+
+		if !serving[host] {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"image": "https://` + host + `/image.simg", "name": "username/container", "version": "v1"}`))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	cp := &ShubConveyorPacker{
+		Insecure:          true,
+		IsolatedTransport: true,
+		Username:          "user",
+		Password:          "secret",
+		Mirrors: []string{
+			"mirror1.example.org",
+			" ",
+			"primary.example.org",
+			"mirror1.example.org/",
+			"mirror2.example.org",
+			"mirror3.example.org",
+		},
+	}
+	defer cp.CleanUp()
+
+	recipe := sytypes.Definition{Header: map[string]string{"from": "primary.example.org/username/container"}}
+	if err := cp.parseRecipe(recipe); err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	if err := cp.getManifest(context.Background()); err != nil {
+		t.Fatalf("unable to get manifest from mirrors: %v", err)
+	}
+
+	if expected := []string{"primary.example.org", "mirror1.example.org", "mirror2.example.org"}; !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("manifest requested from %v, expected %v", hosts, expected)
+	}
+	if expected := map[string]bool{"primary.example.org": true}; !reflect.DeepEqual(auth, expected) {
+		t.Fatalf("credentials sent to %v, expected %v", auth, expected)
+	}
+	if cp.manifest.Image != "https://mirror2.example.org/image.simg" {
+		t.Fatalf("unexpected image %s resolved from mirrors", cp.manifest.Image)
+	}
+}
+
+// TestMirrorProfileCredentials checks that a mirror receives the credentials
+// of its own profile, and not those of the primary registry
+func TestMirrorProfileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-mirror-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv(shubUnixSocketEnv, socket)
+	defer os.Unsetenv(shubUnixSocketEnv)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "mirroruser" || password != "mirrorsecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"image": "https://mirror.example.org/image.simg", "name": "username/container"}`))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	cp := &ShubConveyorPacker{
+		Insecure:          true,
+		IsolatedTransport: true,
+		Username:          "user",
+		Password:          "secret",
+		RegistryProfiles: map[string]RegistryProfile{
+			"mirror.example.org": {Username: "mirroruser", Password: "mirrorsecret"},
+		},
+	}
+	defer cp.CleanUp()
+
+	recipe := sytypes.Definition{Header: map[string]string{"from": "primary.example.org/username/container"}}
+	if err := cp.parseRecipe(recipe); err != nil {
+		t.Fatalf("unable to parse recipe: %v", err)
+	}
+	mirror, err := NewShubURI("mirror.example.org", "username", "container", "", "")
+	if err != nil {
+		t.Fatalf("unable to create mirror reference: %v", err)
+	}
+
+	if err := cp.requestManifest(context.Background(), mirror); err != nil {
+		t.Fatalf("unable to get manifest from mirror with its profile credentials: %v", err)
+	}
+
+	cp.RegistryProfiles = nil
+	if err := cp.requestManifest(context.Background(), mirror); err == nil {
+		t.Fatalf("mirror without profile credentials accepted the request")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// partialMeta is the sidecar of a partial download in PartialDir, telling
+// whether it can be resumed by a later pull
+type partialMeta struct {
+	// URL is the address the image is downloaded from
+	URL string `json:"url"`
+	// Bytes is the size of the partial download when last recorded
+	Bytes int64 `json:"bytes"`
+	// ETag identifies the version of the image being downloaded, so it is
+	// downloaded again when it changed on the server
+	ETag string `json:"etag,omitempty"`
+	// LastModified validates the partial download when the server sends
+	// no ETag
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// partialPaths returns the partial download of the reference in PartialDir
+// and its sidecar
+func (cp *ShubConveyorPacker) partialPaths() (string, string) {
+	sum := sha256.Sum256([]byte(cp.srcURI.Canonical()))
+	base := filepath.Join(cp.PartialDir, hex.EncodeToString(sum[:])+".partial")
+	return base, base + ".json"
+}
+
+// openPartial opens the partial download of the reference in PartialDir,
+// keeping the content left by a previous pull of the same image URL
+func (cp *ShubConveyorPacker) openPartial() (*os.File, error) {
+	if err := os.MkdirAll(cp.PartialDir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create partial downloads directory: %v", err)
+	}
+
+	path, metaPath := cp.partialPaths()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open partial download: %v", err)
+	}
+
+	var meta partialMeta
+	data, err := ioutil.ReadFile(metaPath)
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	}
+	if err == nil && meta.URL == cp.downloadURL() {
+		if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+			sylog.Infof("Resuming partial download of %s from a previous pull", cp.srcURI.String())
+		}
+		cp.etag = meta.ETag
+		cp.lastModified = meta.LastModified
+	} else if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	cp.partial = path
+	cp.savePartial(f)
+	return f, nil
+}
+
+// savePartial records the state of the partial download f in its sidecar
+func (cp *ShubConveyorPacker) savePartial(f *os.File) {
+	fi, err := f.Stat()
+	if err != nil {
+		sylog.Warningf("Could not record partial download: %v", err)
+		return
+	}
+
+	data, err := json.Marshal(partialMeta{URL: cp.downloadURL(), Bytes: fi.Size(), ETag: cp.etag, LastModified: cp.lastModified})
+	if err != nil {
+		return
+	}
+	_, metaPath := cp.partialPaths()
+	if err := ioutil.WriteFile(metaPath, data, 0600); err != nil {
+		sylog.Warningf("Could not record partial download: %v", err)
+	}
+}
+
+// finishPartial copies the completed partial download f to dst and removes it
+func (cp *ShubConveyorPacker) finishPartial(f, dst *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		return fmt.Errorf("could not copy partial download: %v", err)
+	}
+
+	cp.removePartial()
+	return nil
+}
+
+// removePartial removes the partial download and its sidecar
+func (cp *ShubConveyorPacker) removePartial() {
+	path, metaPath := cp.partialPaths()
+	os.Remove(path)
+	os.Remove(metaPath)
+	cp.partial = ""
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+	"github.com/singularityware/singularity/src/pkg/util/user-agent"
+)
+
+// Ping checks that the registry serving the image of recipe is reachable,
+// that its TLS certificate is trusted and that the configured credentials,
+// if any, are accepted. Nothing is pulled, only the registry root is requested
+func (cp *ShubConveyorPacker) Ping(recipe sytypes.Definition) error {
+	if err := cp.parseRecipe(recipe); err != nil {
+		return err
+	}
+
+	return cp.ping(context.Background())
+}
+
+func (cp *ShubConveyorPacker) ping(ctx context.Context) error {
+	u := apiURL(cp.srcURI)
+	u.Path = "/"
+
+	sc := http.Client{
+		Transport:     hostTransport{cp},
+		Timeout:       cp.timeout(u.Hostname()),
+		CheckRedirect: cp.redirectHeaders,
+	}
+
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", useragent.Value)
+	cp.setHeaders(req)
+	cp.setAuth(req)
+	if err := cp.throttle(ctx, req.URL.Hostname()); err != nil {
+		return err
+	}
+
+	res, err := sc.Do(req.WithContext(ctx))
+	if err != nil {
+		if isTLSError(err) {
+			return fmt.Errorf("TLS verification of registry %s failed: %v", u.Host, withClockHint(err))
+		}
+		return fmt.Errorf("registry %s is unreachable: %v", u.Host, err)
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("authentication to registry %s failed: %s", u.Host, res.Status)
+	case res.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("registry %s is not responding properly: %s", u.Host, res.Status)
+	}
+
+	sylog.Infof("Registry %s is reachable: %s", u.Host, res.Status)
+	return nil
+}
+
+// tlsErrorTargets are the errors of the TLS handshake and of the verification
+// of the server certificate, in the value and pointer forms they're returned in
+var tlsErrorTargets = []interface{}{
+	new(*tls.CertificateVerificationError),
+	new(tls.RecordHeaderError),
+	new(*tls.RecordHeaderError),
+	new(x509.UnknownAuthorityError),
+	new(*x509.UnknownAuthorityError),
+	new(x509.CertificateInvalidError),
+	new(*x509.CertificateInvalidError),
+	new(x509.HostnameError),
+	new(*x509.HostnameError),
+}
+
+// isTLSError reports whether err, or any error it wraps, comes from the TLS
+// handshake or the verification of the server certificate
+func isTLSError(err error) bool {
+	for _, target := range tlsErrorTargets {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// PreflightResult is the outcome of the preflight of a registry
+type PreflightResult struct {
+	// Registry is the host of the registry
+	Registry string
+	// Sample is the reference whose manifest was requested
+	Sample string
+	// Err is why the registry failed the preflight, nil when it passed
+	Err error
+}
+
+// PreflightError is returned by Preflight when registries failed it
+type PreflightError struct {
+	Failed []PreflightResult
+}
+
+func (e *PreflightError) Error() string {
+	failures := make([]string, len(e.Failed))
+	for i, r := range e.Failed {
+		failures[i] = fmt.Sprintf("registry %s: %v", r.Registry, r.Err)
+	}
+	return "preflight failed for " + strings.Join(failures, "; ")
+}
+
+// Preflight checks, before a batch of pulls, that the registries serving the
+// references of recipes are reachable and accept the configured credentials,
+// as Ping does, and requests the manifest of the first reference of each as a
+// sample. Each registry is checked once, with the connections and settings
+// of its own profile later pulls reuse. The results are returned by
+// registry, in the order of the references, with a *PreflightError when any
+// failed. The reference and manifest of the packer are left unchanged
+func (cp *ShubConveyorPacker) Preflight(ctx context.Context, recipes []sytypes.Definition) ([]PreflightResult, error) {
+	if cp.DryRun {
+		return nil, ErrDryRun
+	}
+	atomic.StoreInt64(&cp.retriesUsed, 0)
+
+	recipe, srcURI, manifest := cp.recipe, cp.srcURI, cp.manifest
+	defer func() {
+		cp.recipe, cp.srcURI, cp.manifest = recipe, srcURI, manifest
+	}()
+
+	var results []PreflightResult
+	var failed []PreflightResult
+	seen := make(map[string]bool)
+	for _, recipe := range recipes {
+		if err := cp.parseRecipe(recipe); err != nil {
+			return nil, err
+		}
+		host := profileHost(strings.SplitN(cp.srcURI.registry, `/`, 2)[0])
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		result := PreflightResult{Registry: host, Sample: cp.srcURI.String()}
+		if result.Err = cp.ping(ctx); result.Err == nil {
+			if err := cp.getManifestFrom(ctx, cp.srcURI); err != nil {
+				result.Err = fmt.Errorf("manifest request for %s failed: %v", result.Sample, err)
+			}
+		}
+
+		if result.Err != nil {
+			sylog.Warningf("Preflight of registry %s failed: %v", host, result.Err)
+			failed = append(failed, result)
+		} else {
+			sylog.Infof("Preflight of registry %s passed", host)
+		}
+		results = append(results, result)
+	}
+
+	if len(failed) > 0 {
+		return results, &PreflightError{Failed: failed}
+	}
+	return results, nil
+}
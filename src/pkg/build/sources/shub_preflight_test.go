@@ -0,0 +1,139 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/singularityware/singularity/src/pkg/build/sources"
+	"github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+// TestShubPreflight checks that each registry of a batch is checked once, and
+// that rejected credentials fail the preflight
+func TestShubPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-preflight-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the registry is reached through a unix socket, as references can't
+	// hold the port of a test server
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv("SINGULARITY_SHUB_UNIX_SOCKET", socket)
+	defer os.Unsetenv("SINGULARITY_SHUB_UNIX_SOCKET")
+
+	var requests []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"image": "https://storage.example.org/image.simg", "name": "username/container"}`))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	registry := "registry.example.org"
+	var recipes []types.Definition
+	for _, ref := range []string{"username/container", "username/other:tag"} {
+		recipes = append(recipes, types.Definition{Header: map[string]string{"from": "shub://" + registry + "/" + ref}})
+	}
+
+	cp := &sources.ShubConveyorPacker{Insecure: true, IsolatedTransport: true, Username: "user", Password: "secret"}
+	defer cp.CleanUp()
+	results, err := cp.Preflight(context.Background(), recipes)
+	if err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Registry != registry || results[0].Err != nil {
+		t.Fatalf("unexpected preflight results %v", results)
+	}
+	if len(requests) != 2 || requests[0] != "HEAD /" || requests[1] != "GET /username/container" {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+
+	cp.Password = "wrong"
+	results, err = cp.Preflight(context.Background(), recipes)
+	if _, ok := err.(*sources.PreflightError); !ok {
+		t.Fatalf("failed to catch rejected credentials: %v", err)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("unexpected preflight results %v", results)
+	}
+}
+
+// TestShubPreflightProfiles checks that each registry is checked with the
+// TLS settings of its own profile
+func TestShubPreflightProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-preflight-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// both registries are served by the same test server, whose certificate
+	// isn't trusted
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv("SINGULARITY_SHUB_UNIX_SOCKET", socket)
+	defer os.Unsetenv("SINGULARITY_SHUB_UNIX_SOCKET")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"image": "https://storage.example.org/image.simg", "name": "username/container"}`))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	var recipes []types.Definition
+	for _, ref := range []string{"insecure.example.org/username/container", "secure.example.org/username/container"} {
+		recipes = append(recipes, types.Definition{Header: map[string]string{"from": "shub://" + ref}})
+	}
+
+	cp := &sources.ShubConveyorPacker{
+		IsolatedTransport: true,
+		RegistryProfiles: map[string]sources.RegistryProfile{
+			"insecure.example.org": {Insecure: true},
+			"secure.example.org":   {},
+		},
+	}
+	defer cp.CleanUp()
+
+	results, err := cp.Preflight(context.Background(), recipes)
+	perr, ok := err.(*sources.PreflightError)
+	if !ok || len(perr.Failed) != 1 || perr.Failed[0].Registry != "secure.example.org" {
+		t.Fatalf("untrusted certificate of secure.example.org wasn't refused: %v", err)
+	}
+	if msg := perr.Failed[0].Err.Error(); !strings.Contains(msg, "TLS verification of registry secure.example.org failed") {
+		t.Fatalf("untrusted certificate not reported as a TLS failure: %v", msg)
+	}
+	if len(results) != 2 || results[0].Registry != "insecure.example.org" || results[0].Err != nil {
+		t.Fatalf("unexpected preflight results %v", results)
+	}
+
+	if _, ok := cp.Manifest(); ok {
+		t.Fatalf("preflight left the manifest of a sample on the packer")
+	}
+}
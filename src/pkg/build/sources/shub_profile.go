@@ -0,0 +1,83 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RegistryProfile bundles the settings of a registry, applied to the requests
+// sent to its host, whether it is the registry of the reference or one of
+// its mirrors. Settings left to their zero value fall
+// back to the environment and defaults, while the fields of the packer
+// take precedence over the profile
+type RegistryProfile struct {
+	// Timeout bounds each request to the registry
+	Timeout time.Duration
+	// Insecure skips the verification of the TLS certificate of the registry
+	Insecure bool
+	// Username and Password authenticate requests to the registry
+	Username string
+	Password string
+	// PathTemplate is the path of manifests on the registry, replacing the
+	// registry path and reference. {user}, {container}, {tag} and {digest}
+	// are substituted, the tag defaulting to latest, e.g.
+	// /v1/manifests/{user}/{container}/{tag}
+	PathTemplate string
+	// Headers are added to every request to the registry
+	Headers http.Header
+}
+
+// profileHost normalizes host as the key of RegistryProfiles, ignoring
+// case and the `www.` prefix
+func profileHost(host string) string {
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}
+
+// profile returns the RegistryProfile of host, the registry or mirror a
+// request is sent to, if any
+func (cp *ShubConveyorPacker) profile(host string) (RegistryProfile, bool) {
+	if len(cp.RegistryProfiles) == 0 {
+		return RegistryProfile{}, false
+	}
+
+	host = profileHost(host)
+	for h, p := range cp.RegistryProfiles {
+		if profileHost(h) == host {
+			return p, true
+		}
+	}
+	return RegistryProfile{}, false
+}
+
+// manifestURL returns the address of the manifest of uri, built from the
+// PathTemplate of the profile of its registry when it has one
+func (cp *ShubConveyorPacker) manifestURL(uri ShubURI) url.URL {
+	u := apiURL(uri)
+
+	p, ok := cp.profile(u.Hostname())
+	if !ok || p.PathTemplate == "" {
+		return u
+	}
+
+	tag := strings.TrimPrefix(uri.tag, `:`)
+	if tag == "" {
+		tag = "latest"
+	}
+	u.Path = strings.NewReplacer(
+		"{user}", strings.TrimSuffix(uri.user, `/`),
+		"{container}", uri.container,
+		"{tag}", tag,
+		"{digest}", strings.TrimPrefix(uri.digest, `@`),
+	).Replace(p.PathTemplate)
+	if !strings.HasPrefix(u.Path, `/`) {
+		u.Path = `/` + u.Path
+	}
+	return u
+}
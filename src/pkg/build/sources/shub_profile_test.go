@@ -0,0 +1,168 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryProfile(t *testing.T) {
+	cp := &ShubConveyorPacker{
+		RegistryProfiles: map[string]RegistryProfile{
+			"Singularity-Hub.org": {Timeout: time.Minute},
+			"registry.internal": {
+				Timeout:      5 * time.Second,
+				Insecure:     true,
+				Username:     "builder",
+				Password:     "secret",
+				PathTemplate: "v1/manifests/{user}/{container}/{tag}",
+			},
+		},
+	}
+
+	var err error
+	if cp.srcURI, err = ShubParseReference("//username/container"); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	host := cp.registryHost()
+	if cp.timeout(host) != time.Minute || cp.insecure(host) {
+		t.Errorf("profile of the default registry wasn't applied: timeout=%v insecure=%v", cp.timeout(host), cp.insecure(host))
+	}
+	if u := cp.manifestURL(cp.srcURI); u.String() != "https://www.singularity-hub.org/api/container/username/container" {
+		t.Errorf("unexpected manifest URL %s without path template", u.String())
+	}
+
+	// the profile of the host contacted applies, e.g. a mirror of the registry
+	cp.Mirrors = []string{"registry.internal"}
+	uris, err := cp.registries()
+	if err != nil || len(uris) != 2 {
+		t.Fatalf("unexpected registries %v: %v", uris, err)
+	}
+	if u := cp.manifestURL(uris[1]); u.String() != "https://registry.internal/v1/manifests/username/container/latest" {
+		t.Errorf("unexpected manifest URL %s of mirror from path template", u.String())
+	}
+	if cp.timeout("registry.internal") != 5*time.Second || !cp.insecure("registry.internal") {
+		t.Errorf("profile of the internal registry wasn't applied: timeout=%v insecure=%v", cp.timeout("registry.internal"), cp.insecure("registry.internal"))
+	}
+	if creds, ok := cp.credentials("registry.internal"); !ok || creds.username != "builder" || creds.password != "secret" {
+		t.Errorf("unexpected credentials %v from profile", creds)
+	}
+
+	// explicit settings take precedence over the profile
+	cp.Timeout = time.Hour
+	cp.Username = "user"
+	if cp.timeout("registry.internal") != time.Hour {
+		t.Errorf("profile overrode explicit timeout")
+	}
+	if creds, _ := cp.credentials("registry.internal"); creds.username != "user" {
+		t.Errorf("profile overrode explicit credentials")
+	}
+
+	if _, ok := cp.profile("other.registry"); ok {
+		t.Errorf("profile applied to a registry without profile")
+	}
+}
+
+// TestRegistryProfileTransport checks that hosts get a transport configured
+// by their own profile, following changes of the profiles
+func TestRegistryProfileTransport(t *testing.T) {
+	cp := &ShubConveyorPacker{
+		IsolatedTransport: true,
+		RegistryProfiles: map[string]RegistryProfile{
+			"registry.internal": {Insecure: true},
+		},
+	}
+
+	internal, err := cp.httpTransport("registry.internal")
+	if err != nil {
+		t.Fatalf("unable to create transport: %v", err)
+	}
+	hub, err := cp.httpTransport("www.singularity-hub.org")
+	if err != nil {
+		t.Fatalf("unable to create transport: %v", err)
+	}
+	if !internal.TLSClientConfig.InsecureSkipVerify || hub.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("unexpected verification settings: internal insecure=%v, hub insecure=%v",
+			internal.TLSClientConfig.InsecureSkipVerify, hub.TLSClientConfig.InsecureSkipVerify)
+	}
+	if again, _ := cp.httpTransport("registry.internal"); again != internal {
+		t.Fatalf("transport of registry.internal wasn't reused")
+	}
+
+	cp.RegistryProfiles["registry.internal"] = RegistryProfile{}
+	changed, err := cp.httpTransport("registry.internal")
+	if err != nil {
+		t.Fatalf("unable to create transport: %v", err)
+	}
+	if changed.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("profile change ignored by cached transport")
+	}
+}
+
+// TestRegistryProfileRedirect checks that requests redirected from a host
+// with an insecure profile are sent with the TLS settings of their new host
+func TestRegistryProfileRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-profile-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every host is served by the same test server, whose certificate isn't
+	// trusted, through a unix socket
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv(shubUnixSocketEnv, socket)
+	defer os.Unsetenv(shubUnixSocketEnv)
+
+	var target string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "insecure.example.org" {
+			http.Redirect(w, r, "https://"+target+r.URL.Path, http.StatusFound)
+			return
+		}
+		w.Write([]byte(`{"image": "https://storage.example.org/image.simg", "name": "username/container"}`))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	cp := &ShubConveyorPacker{
+		IsolatedTransport: true,
+		RegistryProfiles: map[string]RegistryProfile{
+			"insecure.example.org": {Insecure: true},
+			"mirror.example.org":   {Insecure: true},
+		},
+	}
+	defer cp.CleanUp()
+
+	uri, err := NewShubURI("insecure.example.org", "username", "container", "", "")
+	if err != nil {
+		t.Fatalf("unable to create reference: %v", err)
+	}
+	cp.srcURI = uri
+
+	target = "secure.example.org"
+	if err := cp.requestManifest(context.Background(), uri); err == nil || !isTLSError(err) {
+		t.Fatalf("redirect to %s sent without certificate verification: %v", target, err)
+	}
+
+	target = "mirror.example.org"
+	if err := cp.requestManifest(context.Background(), uri); err != nil {
+		t.Fatalf("redirect to %s, whose profile is insecure, failed: %v", target, err)
+	}
+}
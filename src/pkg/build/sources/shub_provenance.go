@@ -0,0 +1,73 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/util/user-agent"
+)
+
+// ProvenanceFile is the file of the bundle recording where its base image
+// was pulled from, when RecordProvenance is set
+const ProvenanceFile = "shub-provenance.json"
+
+// Provenance records where the base image of a bundle came from
+type Provenance struct {
+	// Reference is the canonical form of the pulled reference
+	Reference string `json:"reference"`
+	// ImageURL is the address the image was downloaded from
+	ImageURL string `json:"imageURL"`
+	// Version is the image version reported by the manifest
+	Version string `json:"version,omitempty"`
+	// Digest is the sha256 digest of the image, as algorithm:sum
+	Digest string `json:"digest"`
+	// Time is when the image was pulled
+	Time time.Time `json:"time"`
+	// UserAgent identifies the client which pulled the image
+	UserAgent string `json:"userAgent"`
+}
+
+// writeProvenance records the provenance of the pulled image in the bundle
+func (cp *ShubConveyorPacker) writeProvenance() error {
+	f, err := os.Open(cp.tmpfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not compute image digest: %v", err)
+	}
+
+	p := Provenance{
+		Reference: cp.srcURI.Canonical(),
+		ImageURL:  redactURL(cp.manifest.Image),
+		Version:   cp.manifest.Version,
+		Digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Time:      time.Now().UTC(),
+		UserAgent: useragent.Value,
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(cp.b.Path, ProvenanceFile)
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write provenance: %v", err)
+	}
+	return nil
+}
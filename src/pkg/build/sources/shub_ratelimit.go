@@ -0,0 +1,97 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// RateLimit bounds the requests sent to a registry host
+type RateLimit struct {
+	// Rate is the sustained number of requests per second
+	Rate float64
+	// Burst is the number of requests that may be sent at once, at least 1
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// tokenBucket implements a RateLimit, one token being spent per request
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiters holds the token bucket of each host, shared by all packers
+// so concurrent pulls from the same host are throttled together
+var rateLimiters = struct {
+	sync.Mutex
+	hosts map[string]*tokenBucket
+}{hosts: make(map[string]*tokenBucket)}
+
+// reserve spends a token and returns how long to wait before it is available
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst := b.limit.burst()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// throttle waits until a request can be sent to host according to its
+// configured rate limit, hosts without limit are never throttled
+func (cp *ShubConveyorPacker) throttle(ctx context.Context, host string) error {
+	limit, ok := cp.RateLimits[host]
+	if !ok || limit.Rate <= 0 {
+		return nil
+	}
+
+	rateLimiters.Lock()
+	b, ok := rateLimiters.hosts[host]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst(), last: time.Now()}
+		rateLimiters.hosts[host] = b
+	}
+	rateLimiters.Unlock()
+
+	b.mu.Lock()
+	b.limit = limit
+	b.mu.Unlock()
+
+	delay := b.reserve(time.Now())
+	if delay == 0 {
+		return nil
+	}
+	sylog.Debugf("Rate limiting requests to %s, waiting %v", host, delay)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := &tokenBucket{limit: RateLimit{Rate: 10, Burst: 3}, tokens: 3, last: start}
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		delay   time.Duration
+	}{
+		{"Burst", 0, 0},
+		{"Burst", 0, 0},
+		{"Burst", 0, 0},
+		{"Exhausted", 0, 100 * time.Millisecond},
+		{"Queued", 0, 200 * time.Millisecond},
+		{"PartialRefill", 100 * time.Millisecond, 200 * time.Millisecond},
+		{"Refilled", 10 * time.Second, 0},
+		{"CappedAtBurst", 10 * time.Second, 0},
+		{"CappedAtBurst", 10 * time.Second, 0},
+		{"CappedAtBurst", 10 * time.Second, 100 * time.Millisecond},
+	}
+
+	for i, s := range steps {
+		if delay := b.reserve(start.Add(s.elapsed)); delay != s.delay {
+			t.Fatalf("step %d (%s): got delay %v, expected %v", i, s.name, delay, s.delay)
+		}
+	}
+
+	if burst := (RateLimit{Rate: 1}).burst(); burst != 1 {
+		t.Fatalf("got burst %v without configured burst, expected 1", burst)
+	}
+}
+
+// resetRateLimiter drops the token bucket shared by packers for host, so
+// tests start with a full bucket
+func resetRateLimiter(host string) {
+	rateLimiters.Lock()
+	delete(rateLimiters.hosts, host)
+	rateLimiters.Unlock()
+}
+
+func TestThrottle(t *testing.T) {
+	resetRateLimiter("burst.example.org")
+	cp := &ShubConveyorPacker{RateLimits: map[string]RateLimit{
+		"burst.example.org": {Rate: 20, Burst: 2},
+	}}
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := cp.throttle(ctx, "burst.example.org"); err != nil {
+			t.Fatalf("unable to throttle: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Fatalf("burst requests delayed by %v", elapsed)
+	}
+
+	if err := cp.throttle(ctx, "burst.example.org"); err != nil {
+		t.Fatalf("unable to throttle: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("request beyond burst only delayed by %v", elapsed)
+	}
+
+	start = time.Now()
+	if err := cp.throttle(ctx, "unlimited.example.org"); err != nil || time.Since(start) > 25*time.Millisecond {
+		t.Fatalf("host without rate limit throttled: %v", err)
+	}
+}
+
+func TestThrottleCancel(t *testing.T) {
+	resetRateLimiter("cancel.example.org")
+	cp := &ShubConveyorPacker{RateLimits: map[string]RateLimit{
+		"cancel.example.org": {Rate: 1, Burst: 1},
+	}}
+
+	if err := cp.throttle(context.Background(), "cancel.example.org"); err != nil {
+		t.Fatalf("unable to throttle: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := cp.throttle(ctx, "cancel.example.org"); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v while waiting, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("cancelled wait returned after %v", elapsed)
+	}
+}
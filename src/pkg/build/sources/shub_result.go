@@ -0,0 +1,55 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// PullResult describes the outcome of a pull from Singularity Hub in a
+// form suitable for JSON output
+type PullResult struct {
+	// Reference is the canonical form of the pulled reference
+	Reference string `json:"reference"`
+	// ImageURL is the address the image was downloaded from
+	ImageURL string `json:"imageURL"`
+	// Size is the size of the image in bytes
+	Size int64 `json:"size"`
+	// Digest is the image version reported by the manifest
+	Digest string `json:"digest"`
+	// CacheHit is true when the image was served by the cache
+	CacheHit bool `json:"cacheHit"`
+	// Repulled is true when a cached image was pulled again as its
+	// version changed on the registry
+	Repulled bool `json:"repulled"`
+	// Duration is the time taken by the pull
+	Duration time.Duration `json:"duration"`
+}
+
+// Result returns the outcome of the last call to Get
+func (cp *ShubConveyorPacker) Result() PullResult {
+	return cp.result
+}
+
+// recordResult fills the pull result once the image has been retrieved and
+// logs its summary
+func (cp *ShubConveyorPacker) recordResult(start time.Time) {
+	cp.result.Reference = cp.srcURI.Canonical()
+	if cp.manifest != nil {
+		cp.result.ImageURL = cp.manifest.Image
+		cp.result.Digest = cp.manifest.Version
+	}
+	cp.result.Duration = time.Since(start)
+
+	source := "network"
+	if cp.result.CacheHit {
+		source = "cache"
+	}
+	sylog.Infof("Pulled %s (%d bytes) from %s in %v", cp.result.Reference, cp.result.Size, source, cp.result.Duration)
+	cp.logf("pulled %s (%d bytes) from %s in %v", cp.result.Reference, cp.result.Size, source, cp.result.Duration)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// httpStatusError is returned when the registry answers with an unexpected status
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.status
+}
+
+// RetryClassifier reports whether a failed request may succeed when retried
+type RetryClassifier func(err error) bool
+
+// IsTransientError is the default RetryClassifier. Network errors, truncated
+// or stalled downloads, corrupt chunks, server errors and rate limiting are
+// transient, while client errors, cancellation and validation failures are
+// permanent
+func IsTransientError(err error) bool {
+	// connections dropped mid-stream are resumed when retried
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *chunkVerifyError, *stallError:
+		return true
+	case *httpStatusError:
+		return e.code >= http.StatusInternalServerError || e.code == http.StatusTooManyRequests
+	case *url.Error:
+		return e.Timeout() || IsTransientError(e.Err)
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether err may not occur again, as decided by the
+// RetryClassifier
+func (cp *ShubConveyorPacker) retryable(err error) bool {
+	if cp.RetryClassifier != nil {
+		return cp.RetryClassifier(err)
+	}
+	return IsTransientError(err)
+}
+
+// retry calls fn until it succeeds, fails permanently or the configured
+// number of retries is exhausted, waiting a little longer between each attempt
+func (cp *ShubConveyorPacker) retry(ctx context.Context, what string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !cp.retryable(err) {
+			return err
+		}
+		if cp.RetryBudget <= 0 && attempt >= cp.Retries {
+			return err
+		}
+
+		delay := time.Duration(attempt+1) * time.Second
+		if cp.RetryBudget > 0 {
+			left := int64(cp.RetryBudget) - atomic.AddInt64(&cp.retriesUsed, 1)
+			if left < 0 {
+				sylog.Warningf("%s failed, retry budget of %d exhausted", what, cp.RetryBudget)
+				return err
+			}
+			sylog.Warningf("%s failed, retrying in %v (%d retries left): %v", what, delay, left, err)
+		} else {
+			sylog.Warningf("%s failed, retrying in %v: %v", what, delay, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/singularityware/singularity/src/pkg/build/sources"
+)
+
+// TestIsTransientError checks the classification of errors for retries
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"Nil", nil, false},
+		{"Validation", errors.New("Image received is not the right size"), false},
+		{"Cancelled", context.Canceled, false},
+		{"Truncated", io.ErrUnexpectedEOF, true},
+		{"ConnectionRefused", &url.Error{Op: "Get", URL: "https://localhost", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{"CancelledRequest", &url.Error{Op: "Get", URL: "https://localhost", Err: context.Canceled}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if transient := sources.IsTransientError(tt.err); transient != tt.transient {
+				t.Fatalf("unexpected classification of %v: transient %v", tt.err, transient)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallError is returned for a download receiving no bytes for too long,
+// which is retried and resumed like a dropped connection
+type stallError struct {
+	idle time.Duration
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("download stalled, no data received for %v", e.idle)
+}
+
+// stallReader reads a response body, updating the time the last bytes were
+// received for its watchdog
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	// last is the time of the last bytes received, in unix nanoseconds
+	last    int64
+	stalled int32
+	done    chan struct{}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&r.last, time.Now().UnixNano())
+	}
+	if err != nil && atomic.LoadInt32(&r.stalled) == 1 {
+		return n, &stallError{idle: r.timeout}
+	}
+	return n, err
+}
+
+// watch closes the body once no bytes were received for the timeout, failing
+// the Read blocked on it
+func (r *stallReader) watch() {
+	ticker := time.NewTicker(r.timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&r.last))) >= r.timeout {
+				atomic.StoreInt32(&r.stalled, 1)
+				r.body.Close()
+				return
+			}
+		}
+	}
+}
+
+// watchStall returns a reader of body failing with a *stallError when no
+// bytes are received for StallTimeout, and a function stopping its watchdog
+// to call once the body is read
+func (cp *ShubConveyorPacker) watchStall(body io.ReadCloser) (io.Reader, func()) {
+	if cp.StallTimeout <= 0 {
+		return body, func() {}
+	}
+
+	r := &stallReader{
+		body:    body,
+		timeout: cp.StallTimeout,
+		last:    time.Now().UnixNano(),
+		done:    make(chan struct{}),
+	}
+	go r.watch()
+	return r, func() { close(r.done) }
+}
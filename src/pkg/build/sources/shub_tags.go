@@ -0,0 +1,136 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/sylog"
+	"github.com/singularityware/singularity/src/pkg/util/user-agent"
+)
+
+// shubTag is a single entry of the tag listing returned by the registry
+type shubTag struct {
+	Tag string `json:"tag"`
+}
+
+// ListTags returns the tags available on the registry for the container
+// referenced by uri, as listed by its `tags` endpoint
+func (cp *ShubConveyorPacker) ListTags(ctx context.Context, uri ShubURI) ([]string, error) {
+	uri.tag = ""
+	uri.digest = ""
+	tagsURL := apiURL(uri)
+	tagsURL.Path += "/tags"
+
+	sc := http.Client{
+		Transport:     hostTransport{cp},
+		Timeout:       cp.timeout(tagsURL.Hostname()),
+		CheckRedirect: cp.redirectHeaders,
+	}
+	req, err := http.NewRequest(http.MethodGet, tagsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", useragent.Value)
+	cp.setHeaders(req)
+	cp.setAuth(req)
+	if err := cp.throttle(ctx, req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+
+	res, err := sc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, withClockHint(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []shubTag
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("could not decode tag list: %v", err)
+	}
+
+	tags := make([]string, 0, len(entries))
+	for _, e := range entries {
+		tags = append(tags, e.Tag)
+	}
+	return tags, nil
+}
+
+// newestSemverTag returns the greatest stable semantic version among the
+// tags of the source URI. Tags which aren't semantic versions are skipped
+func (cp *ShubConveyorPacker) newestSemverTag(ctx context.Context) (string, error) {
+	tags, err := cp.ListTags(ctx, cp.srcURI)
+	if err != nil {
+		return "", fmt.Errorf("could not list tags: %v", err)
+	}
+
+	var newest string
+	var newestVersion semver
+	for _, tag := range tags {
+		v, err := parseSemver(tag)
+		if err != nil {
+			sylog.Debugf("Skipping tag %s: %v", tag, err)
+			continue
+		}
+		if newest == "" || newestVersion.less(v) {
+			newest, newestVersion = tag, v
+		}
+	}
+
+	if newest == "" {
+		return "", fmt.Errorf("no semantic version tag found for %s", cp.srcURI.String())
+	}
+	return newest, nil
+}
+
+// semver holds the numeric components of a stable semantic version
+type semver [3]uint64
+
+// parseSemver parses tags of the form [v]MAJOR.MINOR.PATCH. Pre-release
+// and build suffixes are rejected as they don't denote a stable release
+func parseSemver(tag string) (v semver, err error) {
+	parts := strings.Split(strings.TrimPrefix(tag, "v"), ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("not a semantic version")
+	}
+
+	for i, p := range parts {
+		if len(p) > 1 && p[0] == '0' {
+			return v, fmt.Errorf("leading zero in version component %q", p)
+		}
+		if v[i], err = strconv.ParseUint(p, 10, 64); err != nil {
+			return v, fmt.Errorf("invalid version component %q", p)
+		}
+	}
+
+	return v, nil
+}
+
+// less reports whether v precedes o
+func (v semver) less(o semver) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    semver
+		wantErr bool
+	}{
+		{"1.2.3", semver{1, 2, 3}, false},
+		{"v1.2.3", semver{1, 2, 3}, false},
+		{"0.0.0", semver{0, 0, 0}, false},
+		{"v10.20.30", semver{10, 20, 30}, false},
+		{"V1.2.3", semver{}, true},
+		{"vv1.2.3", semver{}, true},
+		{"1.2.3-rc1", semver{}, true},
+		{"v2.0.0-beta.1", semver{}, true},
+		{"1.2.3+build", semver{}, true},
+		{"01.2.3", semver{}, true},
+		{"1.2", semver{}, true},
+		{"1.2.3.4", semver{}, true},
+		{"1..3", semver{}, true},
+		{"-1.2.3", semver{}, true},
+		{"latest", semver{}, true},
+		{"", semver{}, true},
+	}
+
+	for _, tt := range tests {
+		v, err := parseSemver(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSemver(%q): unexpected error %v", tt.tag, err)
+			continue
+		}
+		if !tt.wantErr && v != tt.want {
+			t.Errorf("parseSemver(%q): got %v, expected %v", tt.tag, v, tt.want)
+		}
+	}
+}
+
+func TestNewestSemverTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shub-tags-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the registry is reached through a unix socket, as references can't
+	// hold the port of a test server
+	socket := filepath.Join(dir, "registry.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %v", socket, err)
+	}
+	os.Setenv(shubUnixSocketEnv, socket)
+	defer os.Unsetenv(shubUnixSocketEnv)
+
+	var tags string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/tags") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(tags))
+	}))
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		tags    string
+		want    string
+		wantErr bool
+	}{
+		{"Newest", `[{"tag": "1.2.0"}, {"tag": "1.10.0"}, {"tag": "1.9.9"}]`, "1.10.0", false},
+		{"Prefixed", `[{"tag": "v1.0.0"}, {"tag": "v2.0.0"}, {"tag": "1.5.0"}]`, "v2.0.0", false},
+		{"Prerelease", `[{"tag": "1.0.0"}, {"tag": "2.0.0-rc1"}, {"tag": "1.1.0+build"}]`, "1.0.0", false},
+		{"NotSemver", `[{"tag": "latest"}, {"tag": "3.0"}, {"tag": "0.1.0"}, {"tag": "nightly"}]`, "0.1.0", false},
+		{"FirstOfEqual", `[{"tag": "1.0.0"}, {"tag": "v1.0.0"}]`, "1.0.0", false},
+		{"None", `[{"tag": "latest"}, {"tag": "1.0.0-alpha"}]`, "", true},
+		{"Empty", `[]`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags = tt.tags
+
+			cp := &ShubConveyorPacker{Insecure: true, IsolatedTransport: true}
+			defer cp.CleanUp()
+			if cp.srcURI, err = ShubParseReference("//registry.example.org/username/container"); err != nil {
+				t.Fatalf("unable to parse reference: %v", err)
+			}
+
+			tag, err := cp.newestSemverTag(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tag != tt.want {
+				t.Fatalf("got tag %q, expected %q", tag, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"os"
+
+	sytypes "github.com/singularityware/singularity/src/pkg/build/types"
+)
+
+// Attributes set on the spans of a pull
+const (
+	TraceReference = "shub.reference"
+	TraceImageURL  = "shub.image.url"
+	TraceBytes     = "shub.image.bytes"
+	TraceCacheHit  = "shub.cache.hit"
+	TraceVerify    = "shub.verify.kind"
+)
+
+// Tracer creates spans around the phases of a pull: resolution of the
+// manifest, download, verification and packing. It lets callers wire pulls
+// to a tracing system such as OpenTelemetry without this package depending
+// on it
+type Tracer interface {
+	// StartSpan starts a span named name, child of the span carried by ctx
+	// if any, and returns a context carrying the new span
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a phase of a pull started by a Tracer
+type Span interface {
+	// SetAttribute annotates the span, with one of the Trace attributes
+	SetAttribute(key string, value interface{})
+	// End ends the span, err being the error the phase failed with if any
+	End(err error)
+}
+
+// noopSpan is the Span of pulls without Tracer
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End(error)                        {}
+
+// startSpan starts the span named name with the Tracer, if any
+func (cp *ShubConveyorPacker) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if cp.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := cp.Tracer.StartSpan(ctx, name)
+	span.SetAttribute(TraceReference, cp.srcURI.Canonical())
+	return ctx, span
+}
+
+// traceResolve resolves the reference of recipe within a span
+func (cp *ShubConveyorPacker) traceResolve(ctx context.Context, recipe sytypes.Definition) (err error) {
+	ctx, span := cp.startSpan(ctx, "shub.resolve")
+	defer func() { span.End(err) }()
+
+	if err = cp.resolve(ctx, recipe); err != nil {
+		return err
+	}
+	span.SetAttribute(TraceReference, cp.srcURI.Canonical())
+	span.SetAttribute(TraceImageURL, redactURL(cp.manifest.Image))
+	return nil
+}
+
+// traceFetch fetches the image into tmpfile within a span
+func (cp *ShubConveyorPacker) traceFetch(ctx context.Context, tmpfile *os.File) (err error) {
+	ctx, span := cp.startSpan(ctx, "shub.download")
+	defer func() { span.End(err) }()
+
+	if err = cp.fetchImage(ctx, tmpfile); err != nil {
+		return err
+	}
+	span.SetAttribute(TraceBytes, cp.result.Size)
+	span.SetAttribute(TraceCacheHit, cp.result.CacheHit)
+	return nil
+}
+
+// traceVerifyDigest verifies the digest of the image at path within a span,
+// a mismatch naming the reference
+func (cp *ShubConveyorPacker) traceVerifyDigest(ctx context.Context, path, expected string) error {
+	_, span := cp.startSpan(ctx, "shub.verify")
+	span.SetAttribute(TraceVerify, "digest")
+	err := verifyDigest(path, expected)
+	if derr, ok := err.(*DigestError); ok {
+		derr.Reference = cp.srcURI.Canonical()
+	}
+	span.End(err)
+	return err
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testSpan records a span started by testTracer
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) End(error)                                  { s.ended = true }
+
+type testSpanKey struct{}
+
+// testTracer records the spans it starts
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestTraceDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testImageContent))
+	}))
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "shub-trace-")
+	if err != nil {
+		t.Fatalf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := md5.Sum([]byte(testImageContent))
+	tracer := &testTracer{}
+	cp := &ShubConveyorPacker{Tracer: tracer}
+	if cp.srcURI, err = ShubParseReference("//username/container@" + hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+	cp.manifest = &shubAPIResponse{Image: srv.URL + "/image"}
+
+	if err := cp.traceFetch(context.Background(), f); err != nil {
+		t.Fatalf("unable to download image: %v", err)
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("unexpected %d spans, expected download and verification", len(tracer.spans))
+	}
+	download, verify := tracer.spans[0], tracer.spans[1]
+	if download.name != "shub.download" || !download.ended {
+		t.Errorf("unexpected download span %+v", download)
+	}
+	if download.attrs[TraceBytes] != int64(len(testImageContent)) || download.attrs[TraceCacheHit] != false {
+		t.Errorf("unexpected download span attributes %v", download.attrs)
+	}
+	if download.attrs[TraceReference] != cp.srcURI.Canonical() {
+		t.Errorf("download span isn't annotated with the reference: %v", download.attrs)
+	}
+	if verify.name != "shub.verify" || verify.parent != download || verify.attrs[TraceVerify] != "digest" || !verify.ended {
+		t.Errorf("unexpected verification span %+v", verify)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	cp := &ShubConveyorPacker{}
+	ctx := context.Background()
+	if spanCtx, span := cp.startSpan(ctx, "shub.pull"); spanCtx != ctx || span != (noopSpan{}) {
+		t.Fatalf("span started without tracer")
+	}
+}
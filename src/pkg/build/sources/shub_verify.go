@@ -0,0 +1,207 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/singularityware/singularity/src/pkg/signing"
+	"github.com/singularityware/singularity/src/pkg/sylog"
+)
+
+// verifySignature checks the signature of the downloaded image against the
+// local keyring, falling back to the key server for unknown signers
+func (cp *ShubConveyorPacker) verifySignature() error {
+	if _, ok := cp.localPacker.(*SIFPacker); !ok {
+		return fmt.Errorf("image is not a SIF and can't be signed")
+	}
+
+	sylog.Infof("Verifying signature of %s", cp.srcURI.String())
+	if err := signing.Verify(cp.tmpfile, cp.AuthToken); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// verifyArch checks that a SIF image is built for the expected Architecture,
+// warning about a mismatch unless StrictArch is set. Images not recording
+// their architecture are accepted
+func (cp *ShubConveyorPacker) verifyArch() error {
+	if _, ok := cp.localPacker.(*SIFPacker); !ok {
+		return nil
+	}
+
+	arch, err := sifArch(cp.tmpfile)
+	if err != nil {
+		return fmt.Errorf("could not read SIF architecture: %v", err)
+	}
+	expected := cp.Architecture
+	if expected == "" {
+		expected = runtime.GOARCH
+	}
+	if arch == "" || arch == expected {
+		return nil
+	}
+
+	msg := fmt.Sprintf("image %s is built for architecture %s, not %s", cp.srcURI.String(), arch, expected)
+	if cp.StrictArch {
+		return errors.New(msg)
+	}
+	sylog.Warningf("%s", msg)
+	return nil
+}
+
+// digestAlgorithms lists the supported digest algorithms with the length of
+// their hexadecimal sums
+var digestAlgorithms = map[string]struct {
+	new  func() hash.Hash
+	size int
+}{
+	"md5":    {md5.New, 32},
+	"sha256": {sha256.New, 64},
+	"sha512": {sha512.New, 128},
+}
+
+// parseDigest returns the algorithm and sum of digest, written either as
+// algorithm:sum or as a bare sum, its length then implying the algorithm
+func parseDigest(digest string) (alg, sum string, err error) {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		alg, sum = digest[:i], digest[i+1:]
+		a, ok := digestAlgorithms[alg]
+		if !ok {
+			return "", "", fmt.Errorf("unsupported digest algorithm %s", alg)
+		}
+		if len(sum) != a.size {
+			return "", "", fmt.Errorf("%s digest must have %d hexadecimal characters", alg, a.size)
+		}
+		return alg, sum, nil
+	}
+
+	for name, a := range digestAlgorithms {
+		if len(digest) == a.size {
+			return name, digest, nil
+		}
+	}
+	return "", "", fmt.Errorf("unsupported digest of %d hexadecimal characters", len(digest))
+}
+
+// expectedDigest returns the digest the image is verified against: the
+// digest of the reference or, failing that, the manifest version when it
+// names its algorithm, bare versions not being guaranteed to be digests
+func (cp *ShubConveyorPacker) expectedDigest() string {
+	if cp.srcURI.digest != "" {
+		return strings.TrimPrefix(cp.srcURI.digest, `@`)
+	}
+
+	if cp.manifest != nil && strings.Contains(cp.manifest.Version, ":") {
+		if _, _, err := parseDigest(cp.manifest.Version); err == nil {
+			return cp.manifest.Version
+		}
+	}
+	return ""
+}
+
+// DigestError is returned when an image doesn't match its expected digest
+type DigestError struct {
+	// Reference is the canonical form of the reference of the image
+	Reference string
+	// Algorithm is the digest algorithm, e.g. sha256
+	Algorithm string
+	// Expected and Actual are the expected and computed hexadecimal sums
+	Expected string
+	Actual   string
+	// Size is the size of the image in bytes
+	Size int64
+}
+
+func (e *DigestError) Error() string {
+	image := "image"
+	if e.Reference != "" {
+		image += " " + e.Reference
+	}
+	return fmt.Sprintf("%s (%d bytes) %s digest mismatch: expected %s, got %s", image, e.Size, e.Algorithm, e.Expected, e.Actual)
+}
+
+// verifyDigest checks that the sum of the file at path matches the expected
+// digest, computed with the algorithm the digest implies. A mismatch returns
+// a *DigestError
+func verifyDigest(path, expected string) error {
+	alg, sum, err := parseDigest(expected)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := digestAlgorithms[alg].new()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("could not compute image digest: %v", err)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sum {
+		return &DigestError{Algorithm: alg, Expected: sum, Actual: actual, Size: size}
+	}
+
+	sylog.Debugf("Verified image %s digest %s", alg, sum)
+	return nil
+}
+
+// imageFormat describes the format of the image at path from its content, to
+// report images which can't be packed
+func imageFormat(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "unreadable"
+	}
+	defer f.Close()
+
+	head := make([]byte, 2048)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "empty"
+	}
+	head = head[:n]
+
+	// images may start with a launch script, skipped for the magic numbers
+	offset := 0
+	if len(head) > 2 && head[0] == '#' && head[1] == '!' {
+		if i := strings.IndexByte(string(head), '\n'); i >= 0 {
+			offset = i + 1
+		}
+	}
+
+	magic := head
+	if len(magic) > 64 {
+		magic = magic[:64]
+	}
+
+	switch {
+	case strings.Contains(string(magic), "SIF_MAGIC"):
+		return "SIF"
+	case strings.HasPrefix(string(head[offset:]), "hsqs"):
+		return "squashfs"
+	case len(head) > offset+1081 && head[offset+1080] == 0x53 && head[offset+1081] == 0xef:
+		return "ext3"
+	}
+	return http.DetectContentType(head)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestVerifyDigest checks that the digest algorithm is inferred from the expected digest
+func TestVerifyDigest(t *testing.T) {
+	f, err := ioutil.TempFile("", "shub-verify-")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("image")
+	f.Close()
+
+	tests := []struct {
+		name   string
+		digest string
+		valid  bool
+	}{
+		{"MD5", "78805a221a988e79ef3f42d7c5bfd418", true},
+		{"SHA256", "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", true},
+		{"PrefixedSHA256", "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", true},
+		{"PrefixedMD5", "md5:78805a221a988e79ef3f42d7c5bfd418", true},
+		{"Mismatch", "sha256:0000000000000000000000000000000000000000000000000000000000000000", false},
+		{"WrongLength", "sha512:78805a221a988e79ef3f42d7c5bfd418", false},
+		{"Unsupported", "sha1:0000000000000000000000000000000000000000", false},
+		{"UnknownLength", "0000000000000000000000000000000000000000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDigest(f.Name(), tt.digest)
+			if tt.valid && err != nil {
+				t.Fatalf("failed to verify digest %s: %v", tt.digest, err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("failed to catch invalid digest %s", tt.digest)
+			}
+		})
+	}
+}
+
+// TestVerifyDigestError checks the details reported on digest mismatch
+func TestVerifyDigestError(t *testing.T) {
+	f, err := ioutil.TempFile("", "shub-verify-")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("image")
+	f.Close()
+
+	expected := "0000000000000000000000000000000000000000000000000000000000000000"
+	err = verifyDigest(f.Name(), "sha256:"+expected)
+	derr, ok := err.(*DigestError)
+	if !ok {
+		t.Fatalf("unexpected error %v, expected a *DigestError", err)
+	}
+	if derr.Algorithm != "sha256" || derr.Expected != expected || derr.Size != 5 {
+		t.Fatalf("unexpected digest error %+v", derr)
+	}
+	if derr.Actual != "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Fatalf("unexpected computed digest %s", derr.Actual)
+	}
+
+	derr.Reference = "registry/username/container:tag"
+	for _, detail := range []string{derr.Reference, "5 bytes", "sha256", expected, derr.Actual} {
+		if !strings.Contains(derr.Error(), detail) {
+			t.Fatalf("error %q doesn't mention %s", derr.Error(), detail)
+		}
+	}
+}
+
+// TestImageFormat checks the description of downloaded image formats
+func TestImageFormat(t *testing.T) {
+	ext3 := make([]byte, 2048)
+	ext3[1080], ext3[1081] = 0x53, 0xef
+
+	tests := []struct {
+		name    string
+		content string
+		format  string
+	}{
+		{"SIF", "#!/usr/bin/env run-singularity\n\x00SIF_MAGIC\x00", "SIF"},
+		{"Squashfs", "hsqs image", "squashfs"},
+		{"SquashfsLaunchScript", "#!/usr/bin/env run-singularity\nhsqs image", "squashfs"},
+		{"Ext3", string(ext3), "ext3"},
+		{"Gzip", "\x1f\x8b\x08\x00", "application/x-gzip"},
+		{"Empty", "", "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "shub-format-")
+			if err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(tt.content)
+			f.Close()
+
+			if format := imageFormat(f.Name()); format != tt.format {
+				t.Fatalf("unexpected format %s, expected %s", format, tt.format)
+			}
+		})
+	}
+}
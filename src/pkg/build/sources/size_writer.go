@@ -0,0 +1,81 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"fmt"
+	"io"
+)
+
+// sizeCheckingWriter counts the bytes written to w, failing writes past a
+// maximum size, and verifies the total against the expected size once done
+type sizeCheckingWriter struct {
+	w        io.Writer
+	expected int64
+	max      int64
+	n        int64
+}
+
+// newSizeCheckingWriter wraps w, expecting exactly expected bytes, or any
+// size when negative, and at most max bytes, or any size when 0
+func newSizeCheckingWriter(w io.Writer, expected, max int64) *sizeCheckingWriter {
+	return &sizeCheckingWriter{w: w, expected: expected, max: max}
+}
+
+func (s *sizeCheckingWriter) Write(p []byte) (int, error) {
+	if s.max > 0 && s.n+int64(len(p)) > s.max {
+		return 0, fmt.Errorf("image exceeds the maximum size of %v bytes", s.max)
+	}
+
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// Written returns the number of bytes written so far
+func (s *sizeCheckingWriter) Written() int64 {
+	return s.n
+}
+
+// Verify checks that the expected number of bytes was written
+func (s *sizeCheckingWriter) Verify() error {
+	if s.expected >= 0 && s.n != s.expected {
+		return fmt.Errorf("Image received is not the right size. Supposed to be: %v  Actually: %v", s.expected, s.n)
+	}
+	return nil
+}
+
+// sizeLimitReader reads r, failing once more than max bytes are received
+// rather than truncating the content like io.LimitReader
+type sizeLimitReader struct {
+	r        io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+func (s *sizeLimitReader) Read(p []byte) (int, error) {
+	if s.exceeded {
+		return 0, s.errTooLarge()
+	}
+
+	// one byte past the limit is enough to tell an oversized image
+	if left := s.max - s.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if s.n > s.max {
+		s.exceeded = true
+		return n - int(s.n-s.max), s.errTooLarge()
+	}
+	return n, err
+}
+
+func (s *sizeLimitReader) errTooLarge() error {
+	return fmt.Errorf("image exceeds the maximum size of %v bytes", s.max)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2018, Sylabs Inc. All rights reserved.
+// This software is licensed under a 3-clause BSD license. Please consult the
+// LICENSE.md file distributed with the sources of this project regarding your
+// rights to use or distribute this software.
+
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSizeCheckingWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int64
+		max      int64
+		copyErr  bool
+		sizeErr  bool
+	}{
+		{"Exact", 5, 0, false, false},
+		{"UnknownSize", -1, 0, false, false},
+		{"Short", 6, 0, false, true},
+		{"Long", 4, 0, false, true},
+		{"WithinMaximum", -1, 5, false, false},
+		{"ExceedsMaximum", -1, 4, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newSizeCheckingWriter(&buf, tt.expected, tt.max)
+
+			_, err := io.Copy(w, strings.NewReader("image"))
+			if (err != nil) != tt.copyErr {
+				t.Fatalf("unexpected copy error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			if err := w.Verify(); (err != nil) != tt.sizeErr {
+				t.Fatalf("unexpected size verification error: %v", err)
+			}
+			if w.Written() != 5 || buf.String() != "image" {
+				t.Fatalf("unexpected content %q of %v bytes", buf.String(), w.Written())
+			}
+		})
+	}
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	content, err := ioutil.ReadAll(&sizeLimitReader{r: strings.NewReader("0123456789"), max: 10})
+	if err != nil || string(content) != "0123456789" {
+		t.Fatalf("unexpected content %q within limit: %v", content, err)
+	}
+
+	content, err = ioutil.ReadAll(&sizeLimitReader{r: strings.NewReader("0123456789"), max: 9})
+	if err == nil {
+		t.Fatalf("oversized content read without error")
+	}
+	if string(content) != "012345678" {
+		t.Fatalf("unexpected content %q read past the limit", content)
+	}
+
+	r := &sizeLimitReader{r: strings.NewReader("0123456789"), max: 4}
+	p := make([]byte, 16)
+	if n, err := r.Read(p); err == nil || n != 4 {
+		t.Fatalf("got %d bytes and error %v on first oversized read, expected 4 bytes and an error", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := r.Read(p); err == nil || n != 0 {
+			t.Fatalf("got %d bytes and error %v reading past the limit, expected 0 bytes and an error", n, err)
+		}
+	}
+
+	// bufio panics on negative read counts
+	br := bufio.NewReaderSize(&sizeLimitReader{r: strings.NewReader(strings.Repeat("x", 64)), max: 4}, 16)
+	if _, err := io.Copy(ioutil.Discard, br); err == nil {
+		t.Fatalf("oversized content copied without error")
+	}
+}
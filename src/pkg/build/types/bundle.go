@@ -49,6 +49,11 @@ func NewBundle(directoryPrefix string) (b *Bundle, err error) {
 	if err != nil {
 		return nil, err
 	}
+	// the temporary directory may be reached through symlinks, the bundle
+	// path is resolved so it is removed where it really is
+	if b.Path, err = filepath.EvalSymlinks(b.Path); err != nil {
+		return nil, err
+	}
 	sylog.Debugf("Created temporary directory for bundle %v\n", b.Path)
 
 	b.FSObjects = map[string]string{